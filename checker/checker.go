@@ -1,8 +1,11 @@
 package checker
 
 import (
-	"fmt"
-	"os"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"yozi/diagnostic"
 	"yozi/node"
 	"yozi/token"
 )
@@ -21,97 +24,357 @@ func typeKindIsInteger(kind node.TypeKind) bool {
 	}
 }
 
-func typeAssert(n node.Node, expected node.Type) node.Type {
-	actual := n.GetType()
+// The literal kind and size of the integer types
+//
+// @TypeKind
+var integerConversions = map[node.TypeKind]struct {
+	kind token.Kind
+	bits int
+}{
+	node.TypeI8:  {token.I8, 8},
+	node.TypeI16: {token.I16, 16},
+	node.TypeI32: {token.I32, 32},
+	node.TypeI64: {token.I64, 64},
+	node.TypeU8:  {token.U8, 8},
+	node.TypeU16: {token.U16, 16},
+	node.TypeU32: {token.U32, 32},
+	node.TypeU64: {token.U64, 64},
+}
+
+// The literal kind and size of the float types
+//
+// @TypeKind
+var floatConversions = map[node.TypeKind]struct {
+	kind token.Kind
+	bits int
+}{
+	node.TypeF32: {token.F32, 32},
+	node.TypeF64: {token.F64, 64},
+}
+
+// Whether the definition is of a type rather than a value
+func nodeIsType(n node.Node) bool {
+	switch n.(type) {
+	case *node.Struct, *node.Enum, *node.Union:
+		return true
+
+	default:
+		return false
+	}
+}
+
+func typeIsError(t node.Type) bool {
+	return t.Kind == node.TypeError
+}
+
+func typeError() node.Type {
+	return node.Type{Kind: node.TypeError}
+}
+
+// Asserts the type of an expression. Untyped constants are converted to the
+// expected type if they fit within it
+func (c *Context) typeAssert(n *node.Node, expected node.Type) node.Type {
+	actual := (*n).GetType()
+	if typeIsError(actual) || typeIsError(expected) {
+		return expected
+	}
+
+	if typeIsUntyped(*n) && expected.Ref == 0 {
+		if typeKindIsInteger(expected.Kind) && !actual.IsFloat() {
+			c.typeConvertInteger(n, expected)
+			return expected
+		}
+
+		if expected.IsFloat() {
+			c.typeConvertFloat(n, expected)
+			return expected
+		}
+	}
+
 	if !actual.Equal(expected) {
-		// Auto cast untyped integer literal to typed integer
-		//
-		// TODO: Perform constant analysis to auto cast arbritary expressions
-		if expected.Ref == 0 && typeKindIsInteger(expected.Kind) {
-			// Expected typed integer
-			if atom, ok := n.(*node.Atom); ok {
-				// Got untyped integer literal
-				if atom.Token.Kind == token.Int {
-					bits := 0
-
-					// @TypeKind
-					conversions := map[node.TypeKind]struct {
-						kind token.Kind
-						bits int
-					}{
-						node.TypeI8:  {token.I8, 8},
-						node.TypeI16: {token.I16, 16},
-						node.TypeI32: {token.I32, 32},
-						node.TypeI64: {token.I64, 64},
-						node.TypeU8:  {token.U8, 8},
-						node.TypeU16: {token.U16, 16},
-						node.TypeU32: {token.U32, 32},
-						node.TypeU64: {token.U64, 64},
-					}
+		c.sink.Error((*n).Literal().Pos, "Expected type %s, got %s", expected, actual)
+		return expected
+	}
 
-					if c, ok := conversions[expected.Kind]; ok {
-						atom.Token.Kind = c.kind
-						bits = c.bits
-					} else {
-						panic("unreachable")
-					}
+	return actual
+}
 
-					atom.Type = expected
-					atom.Token.ParseInteger(bits)
-					return atom.Type
-				}
-			}
+// Converts an untyped integer constant to a typed integer
+func (c *Context) typeConvertInteger(n *node.Node, expected node.Type) {
+	value, ok := c.evaluateUntyped(*n)
+	if !ok {
+		(*n).SetType(expected)
+		return
+	}
+
+	if !constantFits(value, expected) {
+		if atom, ok := (*n).(*node.Atom); ok {
+			c.sink.Error(atom.Token.Pos, "Integer literal '%s' is too large for type %s", atom.Token.Str, expected)
+		} else {
+			c.sink.Error((*n).Literal().Pos, "Constant %s overflows type %s", value, expected)
+		}
+
+		(*n).SetType(expected)
+		return
+	}
+
+	bits := value.Uint64()
+	if value.Sign() < 0 {
+		bits = uint64(value.Int64())
+	}
+
+	*n = constantNew((*n).Literal(), expected, bits)
+}
+
+// Converts an untyped integer or float constant to a typed float
+func (c *Context) typeConvertFloat(n *node.Node, expected node.Type) {
+	if atom, ok := (*n).(*node.Atom); ok {
+		conversion := floatConversions[expected.Kind]
+		atom.Token.Kind = conversion.kind
+		atom.Type = expected
+		if err := atom.Token.ParseFloat(conversion.bits); err != nil {
+			c.sink.Error(atom.Token.Pos, "%s", err)
+		}
+		return
+	}
+
+	var value float64
+	if (*n).GetType().IsFloat() {
+		value = evaluateUntypedFloat(*n)
+	} else {
+		integer, ok := c.evaluateUntyped(*n)
+		if !ok {
+			(*n).SetType(expected)
+			return
+		}
+
+		value, _ = new(big.Float).SetInt(integer).Float64()
+	}
+
+	// Overflowing the f64 of the untyped constant itself is not an error, same
+	// as with the arithmetic of floats at runtime
+	if expected.Kind == node.TypeF32 && !math.IsInf(value, 0) && math.IsInf(float64(float32(value)), 0) {
+		c.sink.Error((*n).Literal().Pos, "Constant %g overflows type %s", value, expected)
+	}
+
+	*n = constantNewFloat((*n).Literal(), expected, value)
+}
+
+// Converts an untyped integer constant to an untyped float, for arithmetic
+// which mixes the two
+func (c *Context) typeUntypedFloat(n *node.Node) {
+	value, ok := c.evaluateUntyped(*n)
+	if !ok {
+		return
+	}
+
+	tok := (*n).Literal()
+	tok.Kind = token.Float
+	tok.Float, _ = new(big.Float).SetInt(value).Float64()
+	tok.Str = strconv.FormatFloat(tok.Float, 'g', -1, 64)
+	*n = &node.Atom{Token: tok, Type: node.Type{Kind: node.TypeF64}}
+}
+
+// Converts an untyped constant which is not given a type by its context to the
+// type of its literals, i64 or f64
+func (c *Context) typeDefault(n *node.Node) node.Type {
+	if typeIsUntyped(*n) {
+		return c.typeAssert(n, (*n).GetType())
+	}
+
+	return (*n).GetType()
+}
+
+// Whether the expression is made up of only untyped literals and arithmetic on
+// them, like 1 << 70. These are evaluated once their type is known
+//
+// @NodeKind
+func typeIsUntyped(n node.Node) bool {
+	switch n := n.(type) {
+	case *node.Atom:
+		return n.Token.Kind == token.Int || n.Token.Kind == token.Float
+
+	case *node.Unary:
+		return (n.Token.Kind == token.Sub || n.Token.Kind == token.BNot) && typeIsUntyped(n.Operand)
+
+	case *node.Binary:
+		switch n.Token.Kind {
+		case token.Add, token.Sub, token.Mul, token.Div, token.Mod, token.Shl, token.Shr, token.BOr, token.BAnd, token.BXor:
+			return typeIsUntyped(n.Lhs) && typeIsUntyped(n.Rhs)
 		}
+	}
+
+	return false
+}
+
+// Whether a value of type 'a' directly stores a value of type 'b'
+func typeContains(a node.Type, b node.Type) bool {
+	if a.Equal(b) {
+		return true
+	}
+
+	if a.Ref == 0 && a.Kind == node.TypeArray {
+		return typeContains(a.Spec.(*node.Array).Item.GetType(), b)
+	}
+
+	return false
+}
+
+func typeSliceOf(item node.Type) node.Type {
+	slice := node.Array{Item: &node.Atom{Type: item}}
+	slice.Type = node.Type{Kind: node.TypeSlice, Spec: &slice}
+	return slice.Type
+}
+
+func typeString() node.Type {
+	return typeSliceOf(node.Type{Kind: node.TypeU8})
+}
+
+// Returns the value of an index if it is known at compile time
+func constantIndex(n node.Node) (uint64, bool) {
+	if atom, ok := n.(*node.Atom); ok && atom.Token.IsInteger() {
+		return atom.Token.Int, true
+	}
+
+	return 0, false
+}
+
+func (c *Context) typeAssertInteger(n node.Node) node.Type {
+	actual := n.GetType()
+	if typeIsError(actual) {
+		return actual
+	}
+
+	if !typeKindIsInteger(actual.Kind) || actual.Ref != 0 {
+		c.sink.Error(n.Literal().Pos, "Expected integer type, got %s", actual)
+		return typeError()
+	}
+
+	return actual
+}
 
-		fmt.Fprintf(os.Stderr, "%s: ERROR: Expected type %s, got %s\n", n.Literal().Pos, expected, actual)
-		os.Exit(1)
+func (c *Context) typeAssertArith(n node.Node) node.Type {
+	actual := n.GetType()
+	if typeIsError(actual) {
+		return actual
+	}
+
+	if !typeKindIsInteger(actual.Kind) && !actual.IsFloat() && actual.Ref == 0 {
+		c.sink.Error(n.Literal().Pos, "Expected arithmetic type, got %s", actual)
+		return typeError()
 	}
 
 	return actual
 }
 
-func typeAssertArith(n node.Node) node.Type {
+// Like typeAssertArith, but functions and enums can also be compared for
+// equality
+func (c *Context) typeAssertEquatable(n node.Node) node.Type {
 	actual := n.GetType()
-	if !typeKindIsInteger(actual.Kind) && actual.Ref == 0 {
-		fmt.Fprintf(os.Stderr, "%s: ERROR: Expected arithmetic type, got %s\n", n.Literal().Pos, actual)
-		os.Exit(1)
+	if (actual.Kind == node.TypeFn || actual.Kind == node.TypeEnum) && actual.Ref == 0 {
+		return actual
+	}
+
+	return c.typeAssertArith(n)
+}
+
+// Like typeAssertArith, but without floats
+func (c *Context) typeAssertBitwise(n node.Node) node.Type {
+	actual := c.typeAssertArith(n)
+	if actual.IsFloat() {
+		c.sink.Error(n.Literal().Pos, "Expected integer type, got %s", actual)
+		return typeError()
 	}
 
 	return actual
 }
 
+// Asserts that both operands of a binary operator have the same type, with
+// untyped constants on the right taking the type of the left. If both are
+// untyped the operation stays untyped, and integers mixed with floats become
+// floats
+func (c *Context) typeAssertOperands(n *node.Binary, assert func(node.Node) node.Type) node.Type {
+	if !typeIsUntyped(n.Lhs) || !typeIsUntyped(n.Rhs) {
+		return c.typeAssert(&n.Rhs, assert(n.Lhs))
+	}
+
+	lhs := assert(n.Lhs)
+	rhs := assert(n.Rhs)
+	if typeIsError(lhs) || typeIsError(rhs) {
+		return typeError()
+	}
+
+	if lhs.IsFloat() == rhs.IsFloat() {
+		return lhs
+	}
+
+	if lhs.IsFloat() {
+		c.typeUntypedFloat(&n.Rhs)
+	} else {
+		c.typeUntypedFloat(&n.Lhs)
+	}
+
+	return node.Type{Kind: node.TypeF64}
+}
+
 func typeIsScalar(t node.Type) bool {
-	return t.Kind == node.TypeBool || t.Kind == node.TypeRawptr || typeKindIsInteger(t.Kind) || t.Ref != 0
+	return t.Kind == node.TypeBool || t.Kind == node.TypeRawptr || t.Kind == node.TypeEnum || typeKindIsInteger(t.Kind) || t.IsFloat() || t.Ref != 0
 }
 
-func typeAssertScalar(n node.Node) node.Type {
+func (c *Context) typeAssertScalar(n node.Node) node.Type {
 	actual := n.GetType()
+	if typeIsError(actual) {
+		return actual
+	}
+
 	if !typeIsScalar(actual) {
-		fmt.Fprintf(os.Stderr, "%s: ERROR: Expected scalar type, got %s\n", n.Literal().Pos, actual)
-		os.Exit(1)
+		c.sink.Error(n.Literal().Pos, "Expected scalar type, got %s", actual)
+		return typeError()
 	}
 
 	return actual
 }
 
 // @TypeKind
-func typeAssertCastable(cast node.Node, from node.Node, to node.Node) node.Type {
+func (c *Context) typeAssertCastable(cast node.Node, from node.Node, to node.Node) node.Type {
 	castFailed := []func(from node.Type, to node.Type) bool{
 		// Non Scalar -> *
 		// *          -> Non Scalar
 		func(from node.Type, to node.Type) bool {
-			return !typeIsScalar(from) || !typeIsScalar(to)
+			isFn := func(t node.Type) bool {
+				return t.Kind == node.TypeFn && t.Ref == 0
+			}
+
+			return !typeIsScalar(from) && !isFn(from) || !typeIsScalar(to) && !isFn(to)
 		},
 
-		// Function -> *
-		// *        -> Function
+		// Function, Function Pointer -> !Raw Pointer
+		// !Raw Pointer               -> Function, Function Pointer
 		func(from node.Type, to node.Type) bool {
 			if from.Kind == node.TypeFn {
-				return true
+				return to.Kind != node.TypeRawptr
 			}
 
 			if to.Kind == node.TypeFn {
-				return true
+				return from.Kind != node.TypeRawptr
+			}
+
+			return false
+		},
+
+		// Enum     -> !Integer
+		// !Integer -> Enum
+		func(from node.Type, to node.Type) bool {
+			if from.Equal(to) {
+				return false
+			}
+
+			if from.Kind == node.TypeEnum && from.Ref == 0 {
+				return !typeKindIsInteger(to.Kind) || to.Ref != 0
+			}
+
+			if to.Kind == node.TypeEnum && to.Ref == 0 {
+				return !typeKindIsInteger(from.Kind) || from.Ref != 0
 			}
 
 			return false
@@ -124,6 +387,20 @@ func typeAssertCastable(cast node.Node, from node.Node, to node.Node) node.Type
 			return (from.Equal(boolType) && to.Ref != 0) || (to.Equal(boolType) && from.Ref != 0)
 		},
 
+		// Float            -> Boolean, Pointer
+		// Boolean, Pointer -> Float
+		func(from node.Type, to node.Type) bool {
+			if from.IsFloat() {
+				return to.Kind == node.TypeBool || to.Kind == node.TypeRawptr || to.Ref != 0
+			}
+
+			if to.IsFloat() {
+				return from.Kind == node.TypeBool || from.Kind == node.TypeRawptr || from.Ref != 0
+			}
+
+			return false
+		},
+
 		// !64-bit Integer -> Pointer
 		// Pointer         -> !64-bit Integer
 		func(from node.Type, to node.Type) bool {
@@ -147,48 +424,88 @@ func typeAssertCastable(cast node.Node, from node.Node, to node.Node) node.Type
 
 	toType := to.GetType()
 	fromType := from.GetType()
+	if typeIsError(fromType) || typeIsError(toType) {
+		return toType
+	}
 
 	for _, fail := range castFailed {
 		if fail(fromType, toType) {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: Cannot cast from %s to %s\n",
-				cast.Literal().Pos,
-				fromType,
-				toType)
-			os.Exit(1)
+			c.sink.Error(cast.Literal().Pos, "Cannot cast from %s to %s", fromType, toType)
+			break
 		}
 	}
 
 	return toType
 }
 
-func errorUndefined(n node.Node, label string) {
+func (c *Context) errorUndefined(n node.Node, label string) {
 	literal := n.Literal()
-	fmt.Fprintf(os.Stderr, "%s: ERROR: Undefined %s '%s'\n", literal.Pos, label, literal.Str)
-	os.Exit(1)
+	c.sink.Error(literal.Pos, "Undefined %s '%s'", label, literal.Str)
 }
 
-func errorRedefinition(n node.Node, prev node.Node, label string) {
+func (c *Context) errorRedefinition(n node.Node, prev node.Node, label string) {
 	literal := n.Literal()
-	fmt.Fprintf(os.Stderr, "%s: ERROR: Redefinition of %s '%s'\n", literal.Pos, label, literal.Str)
-	fmt.Fprintf(os.Stderr, "%s: NOTE: Defined here\n", prev.Literal().Pos)
-	os.Exit(1)
+	c.sink.Error(literal.Pos, "Redefinition of %s '%s'", label, literal.Str).
+		Note(prev.Literal().Pos, "Defined here")
 }
 
 type Context struct {
 	Globals map[string]node.Node
 
+	// Globals in the order they were defined, so that the output does not
+	// depend on the iteration order of a map
+	Ordered []node.Node
+
+	// Global variables which are initialized at runtime, in source order. The
+	// initializers can only refer to the globals defined before them, so this
+	// is also the order they depend on each other in, without any cycles
+	Initializers []*node.Let
+
+	// Temporaries used by the initializers of globals
+	Temps []*node.Let
+
 	locals    []node.Node
 	currentFn *node.Fn
+
+	// The functions being checked, innermost last. Nested functions are
+	// checked within the enclosing ones
+	fnScopes []fnScope
+
+	// The functions which the locals are defined in
+	owners map[node.Node]*node.Fn
+
+	// Values of function type which are assigned or returned, checked once the
+	// captures of the nested functions are known
+	flows []flow
+
+	// The arguments of function type which may outlive the call
+	escapes map[*node.Let]bool
+
+	// The loops enclosing the current statement, innermost last
+	loops []loop
+
+	// The instance of a generic function being checked, whose type parameters
+	// are in scope
+	instance      *node.Fn
+	instanceDepth int
+
+	sink *diagnostic.Sink
 }
 
-func NewContext() Context {
+func NewContext(sink *diagnostic.Sink) Context {
 	return Context{
 		Globals: make(map[string]node.Node),
+		owners:  make(map[node.Node]*node.Fn),
+		escapes: make(map[*node.Let]bool),
+		sink:    sink,
 	}
 }
 
+func (c *Context) globalDefine(n node.Node) {
+	c.Globals[n.Literal().Str] = n
+	c.Ordered = append(c.Ordered, n)
+}
+
 // @TypeKind
 func (c *Context) checkType(n node.Node) {
 	switch n := n.(type) {
@@ -218,6 +535,12 @@ func (c *Context) checkType(n node.Node) {
 		case "u64":
 			n.Type = node.Type{Kind: node.TypeU64}
 
+		case "f32":
+			n.Type = node.Type{Kind: node.TypeF32}
+
+		case "f64":
+			n.Type = node.Type{Kind: node.TypeF64}
+
 		case "bool":
 			n.Type = node.Type{Kind: node.TypeBool}
 
@@ -225,13 +548,47 @@ func (c *Context) checkType(n node.Node) {
 			n.Type = node.Type{Kind: node.TypeRawptr}
 
 		default:
-			errorUndefined(n, "type")
+			if t, ok := c.typeArgFind(n.Token.Str); ok {
+				n.Type = t
+				break
+			}
+
+			switch defined := c.Globals[n.Token.Str].(type) {
+			case *node.Struct, *node.Enum, *node.Union:
+				n.Defined = defined
+				n.Type = defined.GetType()
+
+			default:
+				c.errorUndefined(n, "type")
+				n.Type = typeError()
+			}
 		}
 
 	case *node.Unary:
 		c.checkType(n.Operand)
 		n.Type = n.Operand.GetType()
-		n.Type.Ref++
+		if !typeIsError(n.Type) {
+			n.Type.Ref++
+		}
+
+	case *node.Array:
+		if n.Length == nil {
+			c.checkType(n.Item)
+			n.Type = node.Type{Kind: node.TypeSlice, Spec: n}
+			break
+		}
+
+		c.checkType(n.Item)
+
+		length, ok := n.Length.(*node.Atom)
+		if !ok || !length.Token.IsInteger() {
+			c.sink.Error(n.Length.Literal().Pos, "Expected integer literal as array length")
+			n.Type = typeError()
+			break
+		}
+
+		n.Count = length.Token.Int
+		n.Type = node.Type{Kind: node.TypeArray, Spec: n}
 
 	case *node.Fn:
 		for _, arg := range n.Args {
@@ -267,17 +624,13 @@ func (c *Context) argumentFind(name string, until int) (node.Node, bool) {
 	return nil, false
 }
 
+// The arguments are also locals, defined before the body of the function
 func (c *Context) variableFind(name string) (node.Node, bool) {
-	if c.currentFn != nil {
-		for i := len(c.locals) - 1; i >= 0; i-- {
-			l := c.locals[i]
-			if l.Literal().Str == name {
-				return l, true
-			}
-		}
-
-		if arg, ok := c.argumentFind(name, len(c.currentFn.Args)); ok {
-			return arg, true
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		l := c.locals[i]
+		if l.Literal().Str == name {
+			c.captureLocal(l, i)
+			return l, true
 		}
 	}
 
@@ -286,153 +639,653 @@ func (c *Context) variableFind(name string) (node.Node, bool) {
 	return global, ok
 }
 
-func checkIfMemory(n node.Node, message string) {
-	if !n.IsMemory() {
-		fmt.Fprintf(os.Stderr, "%s: ERROR: %s\n", n.Literal().Pos, message)
-		os.Exit(1)
+// Returns the type which the expression names, if any
+func (c *Context) typeNameFind(n node.Node) node.Node {
+	atom, ok := n.(*node.Atom)
+	if !ok || atom.Token.Kind != token.Ident {
+		return nil
 	}
 
-	var checkIfMemoryImpl func(n node.Node)
-	checkIfMemoryImpl = func(n node.Node) {
-		switch n := n.(type) {
-		case *node.Atom:
-			if let, ok := n.Defined.(*node.Let); ok {
-				if let.Kind == node.LetArg {
-					let.Kind = node.LetLocalArg
-				}
-			}
+	if defined, ok := c.variableFind(atom.Token.Str); ok && nodeIsType(defined) {
+		return defined
+	}
 
-		case *node.Unary:
-			checkIfMemoryImpl(n.Operand)
+	return nil
+}
 
-		case *node.Binary:
-			checkIfMemoryImpl(n.Lhs)
+// xs[start..end]
+func (c *Context) checkSlice(n *node.Binary, bounds *node.Binary) {
+	var item node.Type
 
-		default:
-			panic("unreachable")
+	// Arrays and slices are automatically dereferenced
+	lhsType := n.Lhs.GetType()
+	switch {
+	case typeIsError(lhsType):
+		item = lhsType
+
+	case lhsType.Kind == node.TypeArray && lhsType.Ref <= 1:
+		if lhsType.Ref == 0 {
+			c.checkIfMemory(n.Lhs, "Cannot slice array not in memory")
+		}
+
+		item = lhsType.Spec.(*node.Array).Item.GetType()
+
+	case lhsType.Kind == node.TypeSlice && lhsType.Ref <= 1:
+		item = lhsType.Spec.(*node.Array).Item.GetType()
+
+	case lhsType.Ref != 0:
+		if bounds.Rhs == nil {
+			c.sink.Error(bounds.Token.Pos, "Cannot slice pointer without an end index")
 		}
+
+		item = lhsType
+		item.Ref--
+
+	default:
+		c.sink.Error(n.Lhs.Literal().Pos, "Expected array, slice or pointer, got %s", lhsType)
+		item = typeError()
 	}
-	checkIfMemoryImpl(n)
-}
 
-// @NodeKind
-func (c *Context) Check(n node.Node) {
-	switch n := n.(type) {
-	case *node.Atom:
-		// @TokenKind
-		switch n.Token.Kind {
-		case token.I8:
-			n.Type = node.Type{Kind: node.TypeI8}
+	for _, bound := range []*node.Node{&bounds.Lhs, &bounds.Rhs} {
+		if *bound != nil {
+			c.Check(*bound)
+			c.typeDefault(bound)
+			c.typeAssertInteger(*bound)
+		}
+	}
 
-		case token.I16:
-			n.Type = node.Type{Kind: node.TypeI16}
+	if typeIsError(item) {
+		n.Type = item
+		return
+	}
 
-		case token.I32:
-			n.Type = node.Type{Kind: node.TypeI32}
+	start, startOk := uint64(0), true
+	if bounds.Lhs != nil {
+		start, startOk = constantIndex(bounds.Lhs)
+	}
 
-		case token.I64, token.Int:
-			n.Type = node.Type{Kind: node.TypeI64}
+	if end, ok := constantIndex(bounds.Rhs); ok {
+		if lhsType.Kind == node.TypeArray && end > lhsType.Spec.(*node.Array).Count {
+			c.sink.Error(bounds.Rhs.Literal().Pos, "Index %d is out of bounds for %s", end, lhsType)
+		}
 
-		case token.U8:
-			n.Type = node.Type{Kind: node.TypeU8}
+		if startOk && start > end {
+			c.sink.Error(bounds.Token.Pos, "Slice start %d is greater than end %d", start, end)
+		}
+	}
 
-		case token.U16:
-			n.Type = node.Type{Kind: node.TypeU16}
+	n.Type = typeSliceOf(item)
+}
 
-		case token.U32:
-			n.Type = node.Type{Kind: node.TypeU32}
+func (c *Context) checkIfMemory(n node.Node, message string) {
+	if typeIsError(n.GetType()) {
+		return
+	}
 
-		case token.U64:
-			n.Type = node.Type{Kind: node.TypeU64}
+	if !n.IsMemory() {
+		c.sink.Error(n.Literal().Pos, "%s", message)
+		return
+	}
 
-		case token.Bool:
-			n.Type = (node.Type{Kind: node.TypeBool})
+	forceMemory(n)
+}
 
-		case token.Ident:
-			if defined, ok := c.variableFind(n.Token.Str); ok {
-				n.Defined = defined
-				n.Type = defined.GetType()
-				_, n.Memory = defined.(*node.Let)
-			} else {
-				errorUndefined(n, "identifier")
+// Arguments are passed as values, they need to be moved into memory in order
+// to be referenced
+func forceMemory(n node.Node) {
+	switch n := n.(type) {
+	case *node.Atom:
+		if let, ok := n.Defined.(*node.Let); ok {
+			if let.Kind == node.LetArg {
+				let.Kind = node.LetLocalArg
 			}
+		}
 
-		default:
-			panic("unreachable")
+	case *node.Unary:
+		// Dereferences are always in memory
+
+	case *node.Binary:
+		// Accessing through a pointer or slice is always in memory
+		if lhsType := n.Lhs.GetType(); lhsType.Ref == 0 && lhsType.Kind != node.TypeSlice {
+			forceMemory(n.Lhs)
 		}
 
+	default:
+		panic("unreachable")
+	}
+}
+
+// The position where the source of a node starts, since the token of a node is
+// not necessarily the leftmost one
+//
+// @NodeKind
+func nodeStart(n node.Node) token.Pos {
+	switch n := n.(type) {
+	case *node.Binary:
+		return nodeStart(n.Lhs)
+
 	case *node.Call:
-		c.Check(n.Fn)
+		return nodeStart(n.Fn)
 
-		fnTok := n.Fn.Literal()
-		fnType := n.Fn.GetType()
+	case *node.Instance:
+		return nodeStart(n.Fn)
 
-		if fnType.Kind != node.TypeFn {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: Expected function, got %s\n",
-				fnTok.Pos,
-				fnType,
-			)
-			os.Exit(1)
+	case *node.Block:
+		// The token of a block is its closing brace
+		if len(n.Nodes) != 0 {
+			return nodeStart(n.Nodes[0])
 		}
 
-		if fnType.Ref != 0 {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: Cannot call pointer to function. Dereference it first\n",
-				fnTok.Pos,
-			)
-			os.Exit(1)
+	case *node.While:
+		if n.Label != nil {
+			return n.Label.Pos
 		}
 
-		fnSig := fnType.Spec.(*node.Fn)
-		if len(n.Args) != len(fnSig.Args) {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: Expected %d arguments, got %d\n",
-				n.Token.Pos,
-				len(fnSig.Args),
-				len(n.Args),
-			)
-			os.Exit(1)
+	case *node.For:
+		if n.Label != nil {
+			return n.Label.Pos
 		}
+	}
 
-		for i, aArg := range n.Args {
-			c.Check(aArg)
-			typeAssert(aArg, fnSig.Args[i].Type)
-		}
+	return n.Literal().Pos
+}
 
-		n.Type = fnSig.ReturnType()
+type loop struct {
+	node   node.Node
+	label  *token.Token
+	breaks *bool
+}
 
-	case *node.Unary:
-		// @TokenKind
-		switch n.Token.Kind {
-		case token.Sub:
-			c.Check(n.Operand)
-			n.Type = typeAssertArith(n.Operand)
+// Returns the enclosing loop with the label
+func (c *Context) loopFind(label *token.Token) *loop {
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		if l := &c.loops[i]; l.label != nil && l.label.Str == label.Str {
+			return l
+		}
+	}
 
-		case token.Mul:
-			c.Check(n.Operand)
+	return nil
+}
+
+func (c *Context) checkLoopBody(n node.Node, label *token.Token, breaks *bool, body node.Node) {
+	if label != nil {
+		if previous := c.loopFind(label); previous != nil {
+			c.errorRedefinition(&node.Atom{Token: *label}, &node.Atom{Token: *previous.label}, "label")
+		}
+	}
+
+	c.loops = append(c.loops, loop{node: n, label: label, breaks: breaks})
+	c.Check(body)
+	c.loops = c.loops[:len(c.loops)-1]
+}
+
+// Checks the iterable of a for loop, returning the type of the items
+func (c *Context) checkIterable(n *node.For) node.Type {
+	if bounds, ok := n.Iterable.(*node.Binary); ok {
+		if bounds.Token.Kind == token.DotDot || bounds.Token.Kind == token.DotDotEq {
+			c.Check(bounds.Lhs)
+			c.Check(bounds.Rhs)
+
+			// The type of the bounds follows whichever one is not an untyped constant
+			if typeIsUntyped(bounds.Lhs) && !typeIsUntyped(bounds.Rhs) {
+				bounds.Type = c.typeAssert(&bounds.Lhs, c.typeAssertInteger(bounds.Rhs))
+			} else {
+				c.typeDefault(&bounds.Lhs)
+				bounds.Type = c.typeAssert(&bounds.Rhs, c.typeAssertInteger(bounds.Lhs))
+			}
+
+			if n.Index != nil {
+				c.sink.Error(n.Index.Token.Pos, "Cannot iterate over range with an index")
+			}
+
+			return bounds.Type
+		}
+	}
+
+	c.Check(n.Iterable)
+
+	// Arrays and slices are automatically dereferenced
+	iterableType := n.Iterable.GetType()
+	if typeIsError(iterableType) {
+		return iterableType
+	}
+
+	if (iterableType.Kind != node.TypeArray && iterableType.Kind != node.TypeSlice) || iterableType.Ref > 1 {
+		c.sink.Error(n.Iterable.Literal().Pos, "Expected range, array or slice, got %s", iterableType)
+		return typeError()
+	}
+
+	if n.Index == nil {
+		n.Index = &node.Let{Token: n.Token, Kind: node.LetLocal}
+	} else {
+		c.localDefine(n.Index)
+	}
+
+	n.Index.Type = node.Type{Kind: node.TypeU64}
+	c.currentFn.Locals = append(c.currentFn.Locals, n.Index)
+
+	if iterableType.Kind == node.TypeArray && iterableType.Ref == 0 && !n.Iterable.IsMemory() {
+		n.Temp = c.tempNew(n.Token, iterableType)
+	}
+
+	return iterableType.Spec.(*node.Array).Item.GetType()
+}
+
+// Replaces the pattern with its constant value
+func (c *Context) checkMatchConstant(pattern *node.Node, subjectType node.Type) (uint64, bool) {
+	c.Check(*pattern)
+	c.typeAssert(pattern, subjectType)
+	if typeIsError(subjectType) || typeIsError((*pattern).GetType()) {
+		return 0, false
+	}
+
+	constant := evaluate(*pattern)
+	value, ok := constantScalar(constant)
+	if !ok {
+		c.sink.Error(nodeStart(*pattern), "Expected constant pattern in match")
+		return 0, false
+	}
+
+	*pattern = constant
+	return value, true
+}
+
+// Returns the inclusive range of values matched by the pattern
+func (c *Context) checkMatchPattern(pattern *node.Node, subjectType node.Type) (uint64, uint64, bool) {
+	bounds, ok := (*pattern).(*node.Binary)
+	if !ok || (bounds.Token.Kind != token.DotDot && bounds.Token.Kind != token.DotDotEq) {
+		value, ok := c.checkMatchConstant(pattern, subjectType)
+		return value, value, ok
+	}
+
+	bounds.Type = subjectType
+	first, firstOk := c.checkMatchConstant(&bounds.Lhs, subjectType)
+	last, lastOk := c.checkMatchConstant(&bounds.Rhs, subjectType)
+	if !firstOk || !lastOk {
+		return 0, 0, false
+	}
+
+	if subjectType.Kind == node.TypeBool || subjectType.Kind == node.TypeEnum {
+		c.sink.Error(bounds.Token.Pos, "Cannot match range of %s", subjectType)
+		return 0, 0, false
+	}
+
+	order := constantCompare(first, last, subjectType)
+	if order > 0 || (order == 0 && bounds.Token.Kind == token.DotDot) {
+		c.sink.Error(bounds.Token.Pos, "Empty range in match")
+		return 0, 0, false
+	}
+
+	if bounds.Token.Kind == token.DotDot {
+		last--
+	}
+
+	return first, last, true
+}
+
+func (c *Context) checkMatchArms(n *node.Match) {
+	c.Check(n.Subject)
+	c.typeDefault(&n.Subject)
+
+	subjectType := n.Subject.GetType()
+	if subjectType.Kind == node.TypeUnion && subjectType.Ref == 0 {
+		c.checkUnionArms(n, subjectType.Spec.(*node.Union))
+		return
+	}
+
+	// The patterns cannot be checked without knowing what they match, but the
+	// bodies can still refer to the bindings
+	if typeIsError(subjectType) {
+		for _, arm := range n.Arms {
+			for _, pattern := range arm.Patterns {
+				if call, ok := pattern.(*node.Call); ok {
+					for _, binding := range call.Args {
+						if atom, ok := binding.(*node.Atom); ok && atom.Token.Kind == token.Ident {
+							let := &node.Let{Token: atom.Token, Kind: node.LetLocal, Type: typeError()}
+							arm.Bindings = append(arm.Bindings, let)
+						}
+					}
+				}
+			}
+		}
+
+		n.Exhaustive = true
+		return
+	}
+
+	if !typeIsError(subjectType) && (subjectType.Ref != 0 || (subjectType.Kind != node.TypeBool && subjectType.Kind != node.TypeEnum && !typeKindIsInteger(subjectType.Kind))) {
+		c.sink.Error(n.Subject.Literal().Pos, "Expected integer, boolean, enum or union, got %s", subjectType)
+		subjectType = typeError()
+	}
+
+	// The values matched by the previous patterns
+	type matched struct {
+		first   uint64
+		last    uint64
+		pattern node.Node
+	}
+	covered := []matched{}
+
+	// The patterns which were rejected could have covered anything, so the
+	// exhaustiveness is not reported on top of them
+	rejected := false
+
+	for _, arm := range n.Arms {
+		for i := range arm.Patterns {
+			first, last, ok := c.checkMatchPattern(&arm.Patterns[i], subjectType)
+			if !ok {
+				rejected = true
+				continue
+			}
+
+			pattern := arm.Patterns[i]
+			for _, previous := range covered {
+				if constantCompare(last, previous.first, subjectType) >= 0 && constantCompare(first, previous.last, subjectType) <= 0 {
+					c.sink.Error(nodeStart(pattern), "Duplicate pattern in match").
+						Note(nodeStart(previous.pattern), "Previously matched here")
+					break
+				}
+			}
+
+			covered = append(covered, matched{first: first, last: last, pattern: pattern})
+		}
+	}
+
+	if n.Else != nil || typeIsError(subjectType) || rejected {
+		n.Exhaustive = true
+		return
+	}
+
+	if subjectType.Kind == node.TypeBool {
+		missing := []string{}
+		for _, value := range []uint64{1, 0} {
+			found := false
+			for _, it := range covered {
+				if it.first == value {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				missing = append(missing, strconv.FormatBool(value != 0))
+			}
+		}
+
+		if len(missing) != 0 {
+			c.sink.Error(n.Token.Pos, "Match is not exhaustive, missing %s", strings.Join(missing, " and "))
+		}
+
+		n.Exhaustive = len(missing) == 0
+	}
+
+	if subjectType.Kind == node.TypeEnum {
+		missing := []string{}
+		for _, variant := range subjectType.Spec.(*node.Enum).Variants {
+			value, ok := constantScalar(variant.Constant)
+			found := !ok
+			for _, it := range covered {
+				if it.first == value {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				missing = append(missing, variant.Token.Str)
+			}
+		}
+
+		if len(missing) != 0 {
+			c.sink.Error(n.Token.Pos, "Match is not exhaustive, missing %s", strings.Join(missing, ", "))
+		}
+
+		n.Exhaustive = len(missing) == 0
+	}
+}
+
+// Whether the execution of a statement never continues past its end. Warns
+// about statements which can never be executed
+//
+// @NodeKind
+func (c *Context) checkTerminates(n node.Node) bool {
+	switch n := n.(type) {
+	case *node.Block:
+		for i, stmt := range n.Nodes {
+			if c.checkTerminates(stmt) {
+				if i+1 < len(n.Nodes) {
+					c.sink.Warning(nodeStart(n.Nodes[i+1]), "Unreachable statement")
+				}
+
+				return true
+			}
+		}
+
+		return false
+
+	case *node.If:
+		consequent := c.checkTerminates(n.Consequent)
+		antecedent := c.checkTerminates(n.Antecedent)
+		return consequent && antecedent
+
+	case *node.While:
+		c.checkTerminates(n.Body)
+
+		// Infinite loops only continue if they are exited with a break
+		condition, ok := n.Condition.(*node.Atom)
+		return ok && condition.Token.Kind == token.Bool && condition.Token.Int == 1 && !n.Breaks
+
+	case *node.Match:
+		terminates := n.Exhaustive
+		for _, arm := range n.Arms {
+			if !c.checkTerminates(arm.Body) {
+				terminates = false
+			}
+		}
+
+		if n.Else != nil && !c.checkTerminates(n.Else) {
+			terminates = false
+		}
+
+		return terminates
+
+	case *node.For:
+		c.checkTerminates(n.Body)
+		return false
+
+	case *node.Branch:
+		return n.Loop != nil
+
+	case *node.Return:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Typed literals are checked together with their sign, as the minimum value of
+// a signed type has no positive counterpart, like -128i8
+func (c *Context) checkAtom(n *node.Atom, negated bool) {
+	// @TokenKind
+	switch n.Token.Kind {
+	case token.I8:
+		n.Type = node.Type{Kind: node.TypeI8}
+
+	case token.I16:
+		n.Type = node.Type{Kind: node.TypeI16}
+
+	case token.I32:
+		n.Type = node.Type{Kind: node.TypeI32}
+
+	case token.I64, token.Int:
+		n.Type = node.Type{Kind: node.TypeI64}
+
+	case token.U8:
+		n.Type = node.Type{Kind: node.TypeU8}
+
+	case token.U16:
+		n.Type = node.Type{Kind: node.TypeU16}
+
+	case token.U32:
+		n.Type = node.Type{Kind: node.TypeU32}
+
+	case token.U64:
+		n.Type = node.Type{Kind: node.TypeU64}
+
+	case token.F32:
+		n.Type = node.Type{Kind: node.TypeF32}
+
+	case token.F64, token.Float:
+		n.Type = node.Type{Kind: node.TypeF64}
+
+	case token.Bool:
+		n.Type = (node.Type{Kind: node.TypeBool})
+
+	case token.String:
+		n.Type = typeString()
+
+	case token.Ident:
+		if defined, ok := c.variableFind(n.Token.Str); ok {
+			if nodeIsType(defined) {
+				c.sink.Error(n.Token.Pos, "Cannot use type %s as a value", defined.GetType())
+				n.Type = typeError()
+				break
+			}
+
+			if fn, ok := defined.(*node.Fn); ok && fn.Generics != nil {
+				c.sink.Error(n.Token.Pos, "Cannot use generic function '%s' without instantiating it", fn.Token.Str)
+				n.Type = typeError()
+				break
+			}
+
+			n.Defined = defined
+			n.Type = defined.GetType()
+			_, n.Memory = defined.(*node.Let)
+		} else {
+			c.errorUndefined(n, "identifier")
+			n.Type = typeError()
+		}
+
+	default:
+		panic("unreachable")
+	}
+
+	if n.Type.IsSignedInt() && n.Token.IsInteger() && n.Token.Kind != token.Int && !negated {
+		bits := integerConversions[n.Type.Kind].bits
+		if n.Token.Int >= 1<<(bits-1) {
+			c.sink.Error(n.Token.Pos, "Integer literal '%s' is too large for type %s", n.Token.Str, n.Type)
+		}
+	}
+}
+
+// @NodeKind
+func (c *Context) Check(n node.Node) {
+	switch n := n.(type) {
+	case *node.Atom:
+		c.checkAtom(n, false)
+
+	case *node.Call:
+		if c.checkConstruction(n) || c.checkGenericCall(n) {
+			break
+		}
+
+		c.Check(n.Fn)
+
+		fnTok := n.Fn.Literal()
+		fnType := n.Fn.GetType()
+
+		var fnSig *node.Fn
+		switch {
+		case typeIsError(fnType):
+
+		// Pointers to functions are automatically dereferenced
+		case fnType.Kind != node.TypeFn || fnType.Ref > 1:
+			c.sink.Error(fnTok.Pos, "Expected function, got %s", fnType)
+
+		default:
+			fnSig = fnType.Spec.(*node.Fn)
+		}
+
+		if fnSig == nil {
+			for _, aArg := range n.Args {
+				c.Check(aArg)
+			}
+
+			n.Type = typeError()
+			break
+		}
+
+		if fnSig.Variadic {
+			if len(n.Args) < len(fnSig.Args) {
+				c.sink.Error(
+					n.Token.Pos,
+					"Expected at least %d arguments, got %d",
+					len(fnSig.Args),
+					len(n.Args),
+				)
+			}
+		} else if len(n.Args) != len(fnSig.Args) {
+			c.sink.Error(n.Token.Pos, "Expected %d arguments, got %d", len(fnSig.Args), len(n.Args))
+		}
+
+		for i := range n.Args {
+			c.Check(n.Args[i])
+			if i < len(fnSig.Args) {
+				c.typeAssert(&n.Args[i], fnSig.Args[i].Type)
+
+				// Functions written in C cannot call closures, nor know
+				// how long they can be kept for. Neither can the ones which
+				// are unknown until runtime
+				if callee := calleeOf(n); callee != nil {
+					c.flowArg(n.Args[i], callee.Args[i])
+				} else {
+					c.flowAdd(n.Args[i], nil, nil)
+				}
+			} else if fnSig.Variadic {
+				// Variadic arguments are passed to C
+				c.typeDefault(&n.Args[i])
+				c.typeAssertScalar(n.Args[i])
+			}
+		}
+
+		n.Type = fnSig.ReturnType()
+
+	case *node.Unary:
+		// @TokenKind
+		switch n.Token.Kind {
+		case token.Sub:
+			if atom, ok := n.Operand.(*node.Atom); ok {
+				c.checkAtom(atom, true)
+			} else {
+				c.Check(n.Operand)
+			}
+			n.Type = c.typeAssertArith(n.Operand)
+			if n.Type.Ref == 0 && typeKindIsInteger(n.Type.Kind) && !n.Type.IsSignedInt() && !typeIsUntyped(n.Operand) {
+				c.sink.Error(n.Token.Pos, "Cannot negate unsigned type %s", n.Type)
+				n.Type = typeError()
+				break
+			}
+			c.checkConstantOverflow(n)
+
+		case token.Mul:
+			c.Check(n.Operand)
+
+			operandType := n.Operand.GetType()
+			if typeIsError(operandType) {
+				n.Type = operandType
+				break
+			}
 
-			operandType := n.Operand.GetType()
 			if operandType.Ref == 0 {
 				if operandType.Kind == node.TypeRawptr {
-					fmt.Fprintf(
-						os.Stderr,
-						"%s: ERROR: Cannot dereference raw pointer\n",
-						n.Operand.Literal().Pos,
-					)
+					c.sink.Error(n.Operand.Literal().Pos, "Cannot dereference raw pointer")
 				} else {
-					fmt.Fprintf(
-						os.Stderr,
-						"%s: ERROR: Expected pointer, got %s\n",
-						n.Operand.Literal().Pos,
-						operandType,
-					)
+					c.sink.Error(n.Operand.Literal().Pos, "Expected pointer, got %s", operandType)
 				}
 
-				os.Exit(1)
+				n.Type = typeError()
+				break
 			}
 
 			n.Type = operandType
@@ -441,18 +1294,20 @@ func (c *Context) Check(n node.Node) {
 
 		case token.BAnd:
 			c.Check(n.Operand)
-			checkIfMemory(n.Operand, "Cannot take reference of value not in memory")
+			c.checkIfMemory(n.Operand, "Cannot take reference of value not in memory")
 
 			n.Type = n.Operand.GetType()
-			n.Type.Ref++
+			if !typeIsError(n.Type) {
+				n.Type.Ref++
+			}
 
 		case token.BNot:
 			c.Check(n.Operand)
-			n.Type = typeAssertArith(n.Operand)
+			n.Type = c.typeAssertBitwise(n.Operand)
 
 		case token.LNot:
 			c.Check(n.Operand)
-			n.Type = typeAssert(n.Operand, node.Type{Kind: node.TypeBool})
+			n.Type = c.typeAssert(&n.Operand, node.Type{Kind: node.TypeBool})
 
 		default:
 			panic("unreachable")
@@ -464,56 +1319,279 @@ func (c *Context) Check(n node.Node) {
 		case token.Add, token.Sub, token.Mul, token.Div:
 			c.Check(n.Lhs)
 			c.Check(n.Rhs)
-			n.Type = typeAssert(n.Rhs, typeAssertArith(n.Lhs))
+			n.Type = c.typeAssertOperands(n, c.typeAssertArith)
+			c.checkConstantOverflow(n)
 
 		// These only work on integers, whereas the standard arithmetics branch can also work on floats
-		case token.Shl, token.Shr, token.BOr, token.BAnd:
+		case token.Mod, token.Shl, token.Shr, token.BOr, token.BAnd, token.BXor:
 			c.Check(n.Lhs)
 			c.Check(n.Rhs)
-			n.Type = typeAssert(n.Rhs, typeAssertArith(n.Lhs))
+			n.Type = c.typeAssertOperands(n, c.typeAssertBitwise)
 
 		case token.LOr, token.LAnd:
 			c.Check(n.Lhs)
 			c.Check(n.Rhs)
-			n.Type = typeAssert(n.Rhs, typeAssert(n.Lhs, node.Type{Kind: node.TypeBool}))
+			n.Type = c.typeAssert(&n.Rhs, c.typeAssert(&n.Lhs, node.Type{Kind: node.TypeBool}))
 
 		case token.Set:
 			c.Check(n.Lhs)
-			checkIfMemory(n.Lhs, "Cannot assign to value not in memory")
+			c.checkIfMemory(n.Lhs, "Cannot assign to value not in memory")
 
 			c.Check(n.Rhs)
-			typeAssert(n.Rhs, n.Lhs.GetType())
+			c.typeAssert(&n.Rhs, n.Lhs.GetType())
+			c.flowAdd(n.Rhs, localOf(n.Lhs), nil)
+			n.Type = node.Type{Kind: node.TypeUnit}
+
+		case token.AddSet, token.SubSet, token.MulSet, token.DivSet, token.ModSet, token.ShlSet, token.ShrSet, token.BOrSet, token.BAndSet, token.BXorSet:
+			c.Check(n.Lhs)
+			c.checkIfMemory(n.Lhs, "Cannot assign to value not in memory")
+
+			c.Check(n.Rhs)
+			switch n.Token.Kind {
+			case token.AddSet, token.SubSet, token.MulSet, token.DivSet:
+				c.typeAssert(&n.Rhs, c.typeAssertArith(n.Lhs))
+
+			default:
+				c.typeAssert(&n.Rhs, c.typeAssertBitwise(n.Lhs))
+			}
 			n.Type = node.Type{Kind: node.TypeUnit}
 
 		case token.Gt, token.Ge, token.Lt, token.Le, token.Eq, token.Ne:
 			c.Check(n.Lhs)
 			c.Check(n.Rhs)
-			typeAssert(n.Rhs, typeAssertArith(n.Lhs))
+			if n.Token.Kind == token.Eq || n.Token.Kind == token.Ne {
+				c.typeAssertOperands(n, c.typeAssertEquatable)
+			} else {
+				c.typeAssertOperands(n, c.typeAssertArith)
+			}
+
+			// The result is not a number, so untyped operands take their own type
+			c.typeDefault(&n.Lhs)
+			c.typeDefault(&n.Rhs)
 			n.Type = node.Type{Kind: node.TypeBool}
 
 		case token.As:
 			c.Check(n.Lhs)
 			c.checkType(n.Rhs)
-			n.Type = typeAssertCastable(n, n.Lhs, n.Rhs)
+
+			// Untyped constants cast to numbers are converted directly, so that
+			// they must fit instead of wrapping around
+			to := n.Rhs.GetType()
+			if typeIsUntyped(n.Lhs) && to.Ref == 0 && (to.IsFloat() || typeKindIsInteger(to.Kind) && !n.Lhs.GetType().IsFloat()) {
+				c.typeAssert(&n.Lhs, to)
+			} else {
+				c.typeDefault(&n.Lhs)
+			}
+
+			n.Type = c.typeAssertCastable(n, n.Lhs, n.Rhs)
+			c.checkVariantCast(n)
+			if n.Type.Kind == node.TypeRawptr {
+				c.flowAdd(n.Lhs, nil, nil)
+			}
+
+		case token.LBracket:
+			if c.genericFind(n.Lhs) != nil {
+				c.checkInstance(n, n.Lhs, []node.Node{n.Rhs})
+				break
+			}
+
+			c.Check(n.Lhs)
+			if bounds, ok := n.Rhs.(*node.Binary); ok && bounds.Token.Kind == token.DotDot {
+				c.checkSlice(n, bounds)
+				break
+			}
+
+			// Arrays and slices are automatically dereferenced
+			c.Check(n.Rhs)
+			c.typeDefault(&n.Rhs)
+			c.typeAssertInteger(n.Rhs)
+
+			lhsType := n.Lhs.GetType()
+			if typeIsError(lhsType) {
+				n.Type = lhsType
+				break
+			}
+
+			if (lhsType.Kind != node.TypeArray && lhsType.Kind != node.TypeSlice) || lhsType.Ref > 1 {
+				c.sink.Error(n.Lhs.Literal().Pos, "Expected array or slice, got %s", lhsType)
+				n.Type = typeError()
+				break
+			}
+
+			array := lhsType.Spec.(*node.Array)
+			if lhsType.Kind == node.TypeArray {
+				if index, ok := constantIndex(n.Rhs); ok && index >= array.Count {
+					c.sink.Error(n.Rhs.Literal().Pos, "Index %d is out of bounds for %s", index, lhsType)
+				}
+			}
+
+			// Slices always point to memory
+			n.Type = array.Item.GetType()
+			n.Memory = lhsType.Ref != 0 || lhsType.Kind == node.TypeSlice || n.Lhs.IsMemory()
+			if n.Memory {
+				forceMemory(n)
+			} else if _, ok := constantIndex(n.Rhs); !ok {
+				n.Temp = c.tempNew(n.Token, lhsType)
+			}
+
+		case token.Dot:
+			if e, ok := c.typeNameFind(n.Lhs).(*node.Enum); ok {
+				c.checkVariant(n, e)
+				break
+			}
+
+			if u, ok := c.typeNameFind(n.Lhs).(*node.Union); ok {
+				if variant := c.checkUnionVariant(n, u); variant != nil && len(variant.Fields) != 0 {
+					c.sink.Error(n.Rhs.Literal().Pos, "Missing payload of variant '%s'", variant.Token.Str)
+					n.Type = typeError()
+				}
+				break
+			}
+
+			c.Check(n.Lhs)
+
+			lhsType := n.Lhs.GetType()
+			if typeIsError(lhsType) {
+				n.Type = lhsType
+				break
+			}
+
+			if (lhsType.Kind == node.TypeArray || lhsType.Kind == node.TypeSlice) && lhsType.Ref <= 1 {
+				rhs := n.Rhs.(*node.Atom)
+				switch {
+				case rhs.Token.Str == "len":
+					rhs.Type = node.Type{Kind: node.TypeU64}
+
+				case rhs.Token.Str == "ptr" && lhsType.Kind == node.TypeSlice:
+					rhs.Type = lhsType.Spec.(*node.Array).Item.GetType()
+					rhs.Type.Ref++
+
+				default:
+					c.errorUndefined(rhs, "field")
+					rhs.Type = typeError()
+				}
+
+				n.Type = rhs.Type
+				break
+			}
+
+			// Structures are automatically dereferenced
+			if lhsType.Kind != node.TypeStruct || lhsType.Ref > 1 {
+				c.sink.Error(n.Lhs.Literal().Pos, "Expected structure, got %s", lhsType)
+				n.Type = typeError()
+				break
+			}
+
+			s := lhsType.Spec.(*node.Struct)
+			rhs := n.Rhs.(*node.Atom)
+
+			index := s.Find(rhs.Token.Str)
+			if index == -1 {
+				c.errorUndefined(rhs, "field")
+				n.Type = typeError()
+				break
+			}
+
+			rhs.Defined = s.Fields[index]
+			rhs.Type = s.Fields[index].Type
+
+			n.Type = rhs.Type
+			n.Memory = lhsType.Ref != 0 || n.Lhs.IsMemory()
+			if n.Memory {
+				forceMemory(n)
+			}
 
 		default:
 			panic("unreachable")
 		}
 
+	case *node.Instance:
+		c.checkInstance(n, n.Fn, n.Args)
+
+	case *node.Compound:
+		c.checkType(n.Name)
+
+		nameType := n.Name.GetType()
+		if typeIsError(nameType) || nameType.Kind != node.TypeStruct || nameType.Ref != 0 {
+			if !typeIsError(nameType) {
+				c.sink.Error(n.Name.Literal().Pos, "Expected structure, got %s", nameType)
+			}
+
+			for _, field := range n.Fields {
+				c.Check(field.Assign)
+			}
+
+			n.Type = typeError()
+			break
+		}
+
+		s := nameType.Spec.(*node.Struct)
+		for i, field := range n.Fields {
+			for _, previous := range n.Fields[:i] {
+				if previous.Token.Str == field.Token.Str {
+					c.errorRedefinition(field, previous, "field")
+					break
+				}
+			}
+
+			c.Check(field.Assign)
+
+			index := s.Find(field.Token.Str)
+			if index == -1 {
+				c.errorUndefined(field, "field")
+				continue
+			}
+
+			field.Type = c.typeAssert(&field.Assign, s.Fields[index].Type)
+			c.flowAdd(field.Assign, nil, nil)
+		}
+
+		n.Type = nameType
+
 	case *node.Debug:
 		c.Check(n.Operand)
 		switch n.Token.Kind {
 		case token.DebugAlloc:
-			typeAssert(n.Operand, node.Type{Kind: node.TypeU64})
+			c.typeAssert(&n.Operand, node.Type{Kind: node.TypeU64})
 			n.Type = node.Type{Kind: node.TypeRawptr}
 
 		case token.DebugPrint:
-			typeAssertScalar(n.Operand)
+			c.typeDefault(&n.Operand)
+			if !n.Operand.GetType().Equal(typeString()) {
+				c.typeAssertScalar(n.Operand)
+			}
 
 		default:
 			panic("unreachable")
 		}
 
+	case *node.Intrinsic:
+		for _, arg := range n.Args {
+			c.Check(arg)
+		}
+
+		// The rotations also take the number of bits to rotate by
+		arity := 1
+		if n.Token.Kind == token.Rotl || n.Token.Kind == token.Rotr {
+			arity = 2
+		}
+
+		if len(n.Args) != arity {
+			c.sink.Error(n.Token.Pos, "Expected %d arguments, got %d", arity, len(n.Args))
+			n.Type = typeError()
+			break
+		}
+
+		c.typeDefault(&n.Args[0])
+		n.Type = c.typeAssertInteger(n.Args[0])
+		if arity == 2 {
+			c.typeAssert(&n.Args[1], n.Type)
+		}
+
+		if n.Token.Kind == token.Bswap && !typeIsError(n.Type) && integerConversions[n.Type.Kind].bits == 8 {
+			c.sink.Error(n.Args[0].Literal().Pos, "Cannot swap the bytes of %s", n.Type)
+		}
+
 	case *node.Block:
 		scopeStart := len(c.locals)
 		for _, it := range n.Nodes {
@@ -523,75 +1601,153 @@ func (c *Context) Check(n node.Node) {
 
 	case *node.If:
 		c.Check(n.Condition)
-		typeAssert(n.Condition, node.Type{Kind: node.TypeBool})
+		c.typeAssert(&n.Condition, node.Type{Kind: node.TypeBool})
 		c.Check(n.Consequent)
 		c.Check(n.Antecedent)
 
+	case *node.Match:
+		c.checkMatchArms(n)
+
+		for _, arm := range n.Arms {
+			scopeStart := len(c.locals)
+			for _, binding := range arm.Bindings {
+				c.localDefine(binding)
+			}
+
+			c.Check(arm.Body)
+			c.locals = c.locals[0:scopeStart]
+		}
+
+		if n.Else != nil {
+			scopeStart := len(c.locals)
+			c.Check(n.Else)
+			c.locals = c.locals[0:scopeStart]
+		}
+
 	case *node.While:
 		c.Check(n.Condition)
-		typeAssert(n.Condition, node.Type{Kind: node.TypeBool})
-		c.Check(n.Body)
+		c.typeAssert(&n.Condition, node.Type{Kind: node.TypeBool})
+
+		c.checkLoopBody(n, n.Label, &n.Breaks, n.Body)
+
+	case *node.For:
+		scopeStart := len(c.locals)
+		{
+			n.Item.Type = c.checkIterable(n)
+			if n.Index != nil && n.Index.Token.Str == n.Item.Token.Str {
+				c.errorRedefinition(n.Item, n.Index, "local variable")
+			}
+
+			c.localDefine(n.Item)
+			c.currentFn.Locals = append(c.currentFn.Locals, n.Item)
+			c.checkLoopBody(n, n.Label, &n.Breaks, n.Body)
+		}
+		c.locals = c.locals[0:scopeStart]
+
+	case *node.Branch:
+		if len(c.loops) == 0 {
+			c.sink.Error(n.Token.Pos, "Unexpected %s outside of a loop", token.Names[n.Token.Kind])
+			break
+		}
+
+		loop := &c.loops[len(c.loops)-1]
+		if n.Label != nil {
+			loop = c.loopFind(n.Label)
+			if loop == nil {
+				c.errorUndefined(&node.Atom{Token: *n.Label}, "label")
+				break
+			}
+		}
+
+		if n.Token.Kind == token.Break {
+			*loop.breaks = true
+		}
+		n.Loop = loop.node
 
 	case *node.Return:
+		returnType := c.currentFn.ReturnType()
 		if n.Operand != nil {
 			c.Check(n.Operand)
 			n.Type = n.Operand.GetType()
+
+			// Untyped constants are converted to numeric return types
+			if typeIsUntyped(n.Operand) && returnType.Ref == 0 && (typeKindIsInteger(returnType.Kind) || returnType.IsFloat()) {
+				n.Type = c.typeAssert(&n.Operand, returnType)
+			}
 		} else if c.currentFn.Return != nil {
 			n.Type = node.Type{Kind: node.TypeUnit}
 		}
-		typeAssert(n, c.currentFn.ReturnType())
+
+		var returned node.Node = n
+		c.typeAssert(&returned, returnType)
+
+		if n.Operand != nil {
+			c.flowAdd(n.Operand, nil, c.currentFn)
+		}
 
 	case *node.Fn:
-		if previous, ok := c.Globals[n.Token.Str]; ok {
-			errorRedefinition(n, previous, "global identifier")
+		if c.currentFn != nil || n.Token.Kind == token.Fn {
+			if n.Generics != nil {
+				c.sink.Error(n.Token.Pos, "Nested functions cannot be generic")
+				break
+			}
+
+			c.checkNestedFn(n)
+			break
 		}
 
-		n.Type = node.Type{Kind: node.TypeFn, Spec: n}
+		if n.Generics != nil {
+			c.checkGeneric(n)
+			break
+		}
 
-		c.currentFn = n // TODO: Assuming functions can't be nested
-		{
-			scopeStart := len(c.locals)
-			for i, arg := range n.Args {
-				if previous, ok := c.argumentFind(arg.Token.Str, i); ok {
-					errorRedefinition(arg, previous, "argument")
-				}
+		previous, redefined := c.Globals[n.Token.Str]
+		if redefined {
+			c.errorRedefinition(n, previous, "global identifier")
+		} else {
+			c.globalDefine(n)
+		}
 
-				c.checkType(arg.DefType)
-				arg.Type = arg.DefType.GetType()
-			}
+		n.Type = node.Type{Kind: node.TypeFn, Spec: n}
 
-			if n.Return != nil {
-				c.checkType(n.Return)
-			}
+		c.checkFnBody(n)
 
-			c.Globals[n.Token.Str] = n
-			c.Check(n.Body)
+	case *node.Enum:
+		c.checkEnum(n)
 
-			if n.Return != nil {
-				// TODO: Implement proper return analysis
-				endsWithReturn := len(n.Body.Nodes) > 0
-				if endsWithReturn {
-					_, endsWithReturn = n.Body.Nodes[len(n.Body.Nodes)-1].(*node.Return)
-				}
+	case *node.Union:
+		c.checkUnion(n)
 
-				if !endsWithReturn {
-					fmt.Fprintf(
-						os.Stderr,
-						"%s: ERROR: Expected last statement to be 'return'\n",
-						n.Body.Token.Pos,
-					)
-					os.Exit(1)
+	case *node.Struct:
+		n.Type = node.Type{Kind: node.TypeStruct, Spec: n}
+		if previous, ok := c.Globals[n.Token.Str]; ok {
+			c.errorRedefinition(n, previous, "global identifier")
+		} else {
+			c.globalDefine(n)
+		}
+
+		for i, field := range n.Fields {
+			for _, previous := range n.Fields[:i] {
+				if previous.Token.Str == field.Token.Str {
+					c.errorRedefinition(field, previous, "field")
+					break
 				}
 			}
 
-			c.locals = c.locals[0:scopeStart]
+			c.checkType(field.DefType)
+			field.Type = field.DefType.GetType()
+
+			if typeContains(field.Type, n.Type) {
+				c.sink.Error(field.DefType.Literal().Pos, "Structure %s cannot contain itself", n.Type)
+			}
 		}
-		c.currentFn = nil
 
 	case *node.Let:
+		redefined := false
 		if n.Kind == node.LetGlobal {
-			if previous, ok := c.Globals[n.Token.Str]; ok {
-				errorRedefinition(n, previous, "global identifier")
+			var previous node.Node
+			if previous, redefined = c.Globals[n.Token.Str]; redefined {
+				c.errorRedefinition(n, previous, "global identifier")
 			}
 		}
 
@@ -605,27 +1761,33 @@ func (c *Context) Check(n node.Node) {
 
 			assignType := n.Assign.GetType()
 			if assignType.Equal(node.Type{Kind: node.TypeUnit}) {
-				fmt.Fprintf(
-					os.Stderr,
-					"%s: ERROR: Cannot define variable with type %s\n",
-					n.Token.Pos,
-					assignType,
-				)
-				os.Exit(1)
-			}
-
-			if n.DefType != nil {
-				typeAssert(n.Assign, n.Type)
+				c.sink.Error(n.Token.Pos, "Cannot define variable with type %s", assignType)
+				n.Type = typeError()
+			} else if n.DefType != nil {
+				c.typeAssert(&n.Assign, n.Type)
 			} else {
-				n.Type = assignType
+				n.Type = c.typeDefault(&n.Assign)
 			}
 		}
 
 		if n.Kind == node.LetGlobal {
-			c.Globals[n.Token.Str] = n
+			if n.Assign != nil && !typeIsError(n.Type) {
+				n.Constant = evaluate(n.Assign)
+				if n.Constant == nil {
+					c.Initializers = append(c.Initializers, n)
+				}
+			}
+
+			if !redefined {
+				c.globalDefine(n)
+			}
 		} else {
-			c.locals = append(c.locals, n)
+			c.localDefine(n)
 			c.currentFn.Locals = append(c.currentFn.Locals, n)
+
+			if n.Assign != nil {
+				c.flowAdd(n.Assign, n, nil)
+			}
 		}
 
 	default:
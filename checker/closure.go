@@ -0,0 +1,317 @@
+package checker
+
+import (
+	"slices"
+	"yozi/node"
+	"yozi/token"
+)
+
+// A function which is being checked
+type fnScope struct {
+	fn *node.Fn
+
+	// The locals before this index belong to the enclosing functions
+	localsStart int
+}
+
+// A value of function type which is assigned or returned. Closures reference
+// their captured variables through the stack frame of the function they are
+// defined in, so they must not outlive it
+type flow struct {
+	value  node.Node
+	target *node.Let // The local variable assigned, nil if not a local
+	from   *node.Fn  // The function returned from, nil if not returned
+	arg    *node.Let // The argument passed to, nil if not passed to a known function
+	in     *node.Fn  // The function which the flow happens in
+}
+
+type frameKind = byte
+
+const (
+	// The value captures the locals of the function
+	frameLocal frameKind = iota
+
+	// The value is an argument of the function, which may capture the locals
+	// of any of its callers
+	frameCaller
+
+	// The value is loaded from memory within the function, and may capture
+	// anything a pointer can reach
+	frameMemory
+)
+
+// A stack frame which the value of a function may reference
+type frame struct {
+	fn   *node.Fn
+	kind frameKind
+	arg  *node.Let // The argument which the value is, for frameCaller
+}
+
+func (c *Context) localDefine(n node.Node) {
+	c.locals = append(c.locals, n)
+	c.owners[n] = c.currentFn
+}
+
+// Locals of enclosing functions are captured by reference, by the function
+// which references them and every function in between
+func (c *Context) captureLocal(n node.Node, index int) {
+	captured := false
+	for i := len(c.fnScopes) - 1; i >= 0 && index < c.fnScopes[i].localsStart; i-- {
+		fn := c.fnScopes[i].fn
+		if !slices.Contains(fn.Captures, n) {
+			fn.Captures = append(fn.Captures, n)
+		}
+
+		captured = true
+	}
+
+	// Arguments are passed as values, they need to be moved into memory in
+	// order to be referenced
+	if let, ok := n.(*node.Let); ok && captured && let.Kind == node.LetArg {
+		let.Kind = node.LetLocalArg
+	}
+}
+
+// Nested functions and function literals
+func (c *Context) checkNestedFn(n *node.Fn) {
+	n.Type = node.Type{Kind: node.TypeFn, Spec: n}
+
+	if c.currentFn == nil {
+		// Function literals in the initializers of globals cannot capture
+		// anything, they are compiled like global functions
+		c.Ordered = append(c.Ordered, n)
+	} else {
+		n.Parent = c.currentFn
+		n.Unchecked = c.currentFn.Unchecked
+		c.currentFn.Locals = append(c.currentFn.Locals, n)
+
+		// Named functions are in scope within their own body
+		if n.Token.Kind == token.Ident {
+			c.localDefine(n)
+		}
+	}
+
+	c.checkFnBody(n)
+}
+
+// Checks the arguments and body of a function, with the locals of the
+// enclosing functions in scope
+func (c *Context) checkFnBody(n *node.Fn) {
+	previousFn := c.currentFn
+	previousLoops := c.loops
+	scopeStart := len(c.locals)
+
+	c.currentFn = n
+	c.loops = nil
+	c.fnScopes = append(c.fnScopes, fnScope{fn: n, localsStart: scopeStart})
+	{
+		for i, arg := range n.Args {
+			if previous, ok := c.argumentFind(arg.Token.Str, i); ok {
+				c.errorRedefinition(arg, previous, "argument")
+			}
+
+			c.checkType(arg.DefType)
+			arg.Type = arg.DefType.GetType()
+			c.localDefine(arg)
+		}
+
+		if n.Return != nil {
+			c.checkType(n.Return)
+		}
+
+		if !n.Extern {
+			c.Check(n.Body)
+
+			if !c.checkTerminates(n.Body) && n.Return != nil {
+				if n.Token.Kind == token.Fn {
+					c.sink.Error(n.Body.Token.Pos, "Missing return in function literal")
+				} else {
+					c.sink.Error(n.Body.Token.Pos, "Missing return in function '%s'", n.Token.Str)
+				}
+			}
+		}
+	}
+	c.fnScopes = c.fnScopes[:len(c.fnScopes)-1]
+	c.locals = c.locals[0:scopeStart]
+	c.loops = previousLoops
+	c.currentFn = previousFn
+
+	if n.Parent == nil {
+		c.checkFlows()
+		c.flows = nil
+	}
+}
+
+// Records a value which is assigned to the local variable, or returned from
+// the function. If both are nil, the value is stored somewhere which outlives
+// every function
+func (c *Context) flowAdd(value node.Node, target *node.Let, from *node.Fn) {
+	if t := value.GetType(); t.Kind != node.TypeFn || t.Ref != 0 {
+		return
+	}
+
+	c.flows = append(c.flows, flow{value: value, target: target, from: from, in: c.currentFn})
+}
+
+// Records a value which is passed to an argument of a function known at
+// compile time. It is only an escape if the argument is
+func (c *Context) flowArg(value node.Node, arg *node.Let) {
+	if t := value.GetType(); t.Kind != node.TypeFn || t.Ref != 0 {
+		return
+	}
+
+	c.flows = append(c.flows, flow{value: value, arg: arg, in: c.currentFn})
+}
+
+// Returns the function which the call is known to call at compile time, if any
+func calleeOf(n *node.Call) *node.Fn {
+	if atom, ok := n.Fn.(*node.Atom); ok {
+		if fn, ok := atom.Defined.(*node.Fn); ok && !fn.Extern {
+			return fn
+		}
+	}
+
+	return nil
+}
+
+// Returns the local variable which the expression refers to, if any
+func localOf(n node.Node) *node.Let {
+	if atom, ok := n.(*node.Atom); ok {
+		if let, ok := atom.Defined.(*node.Let); ok && let.Kind != node.LetGlobal {
+			return let
+		}
+	}
+
+	return nil
+}
+
+// Whether the function is defined within the other one, or is the same one
+func fnEncloses(outer *node.Fn, inner *node.Fn) bool {
+	for fn := inner; fn != nil; fn = fn.Parent {
+		if fn == outer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports the closures which may outlive the stack frame of the function they
+// are defined in. Must be called after the outermost function is checked, as
+// the captures of nested functions are only known then
+func (c *Context) checkFlows() {
+	// The frames which the values of a local variable reference
+	frames := map[*node.Let][]frame{}
+
+	var framesOf func(n node.Node, in *node.Fn) []frame
+	framesOf = func(n node.Node, in *node.Fn) []frame {
+		if t := n.GetType(); t.Kind != node.TypeFn || t.Ref != 0 {
+			return nil
+		}
+
+		switch n := n.(type) {
+		case *node.Atom:
+			if let, ok := n.Defined.(*node.Let); ok {
+				if let.Kind == node.LetArg || let.Kind == node.LetLocalArg {
+					return append(frames[let], frame{fn: c.owners[let], kind: frameCaller, arg: let})
+				}
+
+				return frames[let]
+			}
+
+			if fn, ok := n.Defined.(*node.Fn); ok && len(fn.Captures) != 0 {
+				return []frame{{fn: fn.Parent, kind: frameLocal}}
+			}
+
+		case *node.Fn:
+			if len(n.Captures) != 0 {
+				return []frame{{fn: n.Parent, kind: frameLocal}}
+			}
+
+		case *node.Call:
+			// The result may be any of the functions passed, or anything the
+			// function called can reference
+			result := framesOf(n.Fn, in)
+			for _, arg := range n.Args {
+				result = append(result, framesOf(arg, in)...)
+			}
+
+			return result
+
+		case *node.Unary:
+			if n.Token.Kind == token.Mul {
+				return []frame{{fn: in, kind: frameMemory}}
+			}
+
+		case *node.Binary:
+			// Instances of generic functions are global
+			if lhs := n.Lhs.GetType(); n.Token.Kind == token.LBracket && lhs.Kind == node.TypeFn && lhs.Ref == 0 {
+				break
+			}
+
+			if n.Token.Kind == token.LBracket || n.Token.Kind == token.Dot {
+				return []frame{{fn: in, kind: frameMemory}}
+			}
+		}
+
+		return nil
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, f := range c.flows {
+			if f.target == nil {
+				continue
+			}
+
+			for _, fr := range framesOf(f.value, f.in) {
+				if !slices.Contains(frames[f.target], fr) {
+					frames[f.target] = append(frames[f.target], fr)
+					changed = true
+				}
+			}
+		}
+	}
+
+	escapesAt := func(f flow, fr frame) bool {
+		switch {
+		case f.target != nil:
+			// Variables of the enclosing functions outlive nested ones
+			owner := c.owners[f.target]
+			return fr.fn != owner && fnEncloses(owner, fr.fn)
+
+		case f.from != nil:
+			// Arguments outlive the function they are passed to
+			return fr.fn == f.from && fr.kind != frameCaller
+
+		case f.arg != nil:
+			return c.escapes[f.arg]
+
+		default:
+			return true
+		}
+	}
+
+	// Arguments which escape are not errors by themselves, the values passed
+	// to them are. Marking one can make the arguments passed to it escape too
+	for changed := true; changed; {
+		changed = false
+		for _, f := range c.flows {
+			for _, fr := range framesOf(f.value, f.in) {
+				if fr.kind == frameCaller && !c.escapes[fr.arg] && escapesAt(f, fr) {
+					c.escapes[fr.arg] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	for _, f := range c.flows {
+		for _, fr := range framesOf(f.value, f.in) {
+			if fr.kind != frameCaller && escapesAt(f, fr) {
+				c.sink.Error(f.value.Literal().Pos, "Closure cannot outlive the variables it captures")
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,684 @@
+package checker
+
+import (
+	"cmp"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"yozi/node"
+	"yozi/token"
+)
+
+// Integer constants are stored in the 64-bit representation of their value,
+// sign extended for signed types
+func constantNormalize(value uint64, t node.Type) uint64 {
+	bits := integerConversions[t.Underlying().Kind].bits
+	if bits == 64 {
+		return value
+	}
+
+	value &= 1<<bits - 1
+	if t.IsSignedInt() && value&(1<<(bits-1)) != 0 {
+		value |= ^uint64(0) << bits
+	}
+
+	return value
+}
+
+func constantNew(tok token.Token, t node.Type, value uint64) *node.Atom {
+	if t.Kind == node.TypeBool {
+		tok.Kind = token.Bool
+		tok.Str = strconv.FormatBool(value != 0)
+	} else {
+		value = constantNormalize(value, t)
+		tok.Kind = integerConversions[t.Underlying().Kind].kind
+		if t.IsSignedInt() {
+			tok.Str = strconv.FormatInt(int64(value), 10)
+		} else {
+			tok.Str = strconv.FormatUint(value, 10)
+		}
+	}
+
+	tok.Int = value
+	return &node.Atom{Token: tok, Type: t}
+}
+
+func constantCompare(a uint64, b uint64, t node.Type) int {
+	if t.IsSignedInt() {
+		return cmp.Compare(int64(a), int64(b))
+	}
+
+	return cmp.Compare(a, b)
+}
+
+func constantNewFloat(tok token.Token, t node.Type, value float64) *node.Atom {
+	if t.Kind == node.TypeF32 {
+		value = float64(float32(value))
+	}
+
+	tok.Kind = floatConversions[t.Kind].kind
+	tok.Str = strconv.FormatFloat(value, 'g', -1, 64)
+	tok.Float = value
+	return &node.Atom{Token: tok, Type: t}
+}
+
+func constantFloat(n node.Node) (float64, bool) {
+	if atom, ok := n.(*node.Atom); ok && atom.Token.IsFloat() {
+		return atom.Token.Float, true
+	}
+
+	return 0, false
+}
+
+// Returns the integer or boolean value of a constant
+func constantScalar(n node.Node) (uint64, bool) {
+	if atom, ok := n.(*node.Atom); ok {
+		if atom.Token.IsInteger() || atom.Token.Kind == token.Bool {
+			return atom.Token.Int, true
+		}
+	}
+
+	return 0, false
+}
+
+// Whether the value fits within the integer type
+func constantFits(value *big.Int, t node.Type) bool {
+	bits := integerConversions[t.Kind].bits
+	if !t.IsSignedInt() {
+		return value.Sign() >= 0 && value.BitLen() <= bits
+	}
+
+	// The magnitude of a negative value is one more than its bits allow
+	if value.Sign() < 0 {
+		return new(big.Int).Not(value).BitLen() < bits
+	}
+
+	return value.BitLen() < bits
+}
+
+// Returns the exact value of a typed integer constant
+func constantBig(value uint64, t node.Type) *big.Int {
+	if t.IsSignedInt() {
+		return big.NewInt(int64(value))
+	}
+
+	return new(big.Int).SetUint64(value)
+}
+
+// Reports the arithmetic on typed constants which overflows, which debug mode
+// would trap on at runtime. Checked wherever the arithmetic appears, as the
+// operands are evaluated on their own first
+//
+// @TokenKind
+func (c *Context) checkConstantOverflow(n node.Node) {
+	t := n.GetType()
+	if t.Ref != 0 || !typeKindIsInteger(t.Kind) || typeIsUntyped(n) {
+		return
+	}
+
+	var value *big.Int
+	switch n := n.(type) {
+	case *node.Unary:
+		// Negated literals are range checked already, and the minimum of a
+		// type is the negation of a literal which wraps
+		if atom, ok := n.Operand.(*node.Atom); ok && atom.Token.IsInteger() || !t.IsSignedInt() {
+			return
+		}
+
+		operand, ok := constantScalar(evaluate(n.Operand))
+		if !ok {
+			return
+		}
+
+		value = new(big.Int).Neg(constantBig(operand, t))
+
+	case *node.Binary:
+		lhs, ok := constantScalar(evaluate(n.Lhs))
+		if !ok {
+			return
+		}
+
+		rhs, ok := constantScalar(evaluate(n.Rhs))
+		if !ok {
+			return
+		}
+
+		switch n.Token.Kind {
+		case token.Add:
+			value = new(big.Int).Add(constantBig(lhs, t), constantBig(rhs, t))
+
+		case token.Sub:
+			value = new(big.Int).Sub(constantBig(lhs, t), constantBig(rhs, t))
+
+		case token.Mul:
+			value = new(big.Int).Mul(constantBig(lhs, t), constantBig(rhs, t))
+
+		default:
+			return
+		}
+	}
+
+	if !constantFits(value, t) {
+		c.sink.Error(n.Literal().Pos, "Constant %s overflows type %s", value, t)
+	}
+}
+
+// Shifting untyped constants further than this is rejected, as the result
+// could not fit in any type anyway
+const untypedShiftLimit = 1024
+
+// Evaluates an untyped integer constant with arbitrary precision, such that
+// only the final value has to fit within its type. Operations which are
+// undefined are reported
+//
+// @TokenKind
+func (c *Context) evaluateUntyped(n node.Node) (*big.Int, bool) {
+	switch n := n.(type) {
+	case *node.Atom:
+		return new(big.Int).SetUint64(n.Token.Int), true
+
+	case *node.Unary:
+		operand, ok := c.evaluateUntyped(n.Operand)
+		if !ok {
+			return nil, false
+		}
+
+		if n.Token.Kind == token.BNot {
+			return operand.Not(operand), true
+		}
+
+		return operand.Neg(operand), true
+
+	case *node.Binary:
+		lhs, ok := c.evaluateUntyped(n.Lhs)
+		if !ok {
+			return nil, false
+		}
+
+		rhs, ok := c.evaluateUntyped(n.Rhs)
+		if !ok {
+			return nil, false
+		}
+
+		switch n.Token.Kind {
+		case token.Add:
+			return lhs.Add(lhs, rhs), true
+
+		case token.Sub:
+			return lhs.Sub(lhs, rhs), true
+
+		case token.Mul:
+			return lhs.Mul(lhs, rhs), true
+
+		case token.Div, token.Mod:
+			if rhs.Sign() == 0 {
+				c.sink.Error(n.Token.Pos, "Division by zero")
+				return nil, false
+			}
+
+			// Truncated like the division of the integer types
+			if n.Token.Kind == token.Mod {
+				return lhs.Rem(lhs, rhs), true
+			}
+
+			return lhs.Quo(lhs, rhs), true
+
+		case token.Shl, token.Shr:
+			if rhs.Sign() < 0 || rhs.Cmp(big.NewInt(untypedShiftLimit)) > 0 {
+				c.sink.Error(n.Token.Pos, "Invalid shift count %s", rhs)
+				return nil, false
+			}
+
+			if n.Token.Kind == token.Shl {
+				return lhs.Lsh(lhs, uint(rhs.Uint64())), true
+			}
+
+			return lhs.Rsh(lhs, uint(rhs.Uint64())), true
+
+		case token.BOr:
+			return lhs.Or(lhs, rhs), true
+
+		case token.BAnd:
+			return lhs.And(lhs, rhs), true
+
+		case token.BXor:
+			return lhs.Xor(lhs, rhs), true
+		}
+	}
+
+	panic("unreachable")
+}
+
+// Evaluates an untyped float constant
+//
+// @TokenKind
+func evaluateUntypedFloat(n node.Node) float64 {
+	switch n := n.(type) {
+	case *node.Atom:
+		return n.Token.Float
+
+	case *node.Unary:
+		return -evaluateUntypedFloat(n.Operand)
+
+	case *node.Binary:
+		lhs := evaluateUntypedFloat(n.Lhs)
+		rhs := evaluateUntypedFloat(n.Rhs)
+
+		switch n.Token.Kind {
+		case token.Add:
+			return lhs + rhs
+
+		case token.Sub:
+			return lhs - rhs
+
+		case token.Mul:
+			return lhs * rhs
+
+		case token.Div:
+			return lhs / rhs
+		}
+	}
+
+	panic("unreachable")
+}
+
+// Evaluates an expression at compile time. The result is made up of literals,
+// references to globals and compound literals, which can be emitted directly
+// into the data of the program.
+//
+// Returns nil if the value depends on the state of the program, like calling
+// a function or reading a variable. Operations which are undefined at runtime,
+// like division by zero, are not evaluated either
+//
+// @NodeKind
+func evaluate(n node.Node) node.Node {
+	switch n := n.(type) {
+	case *node.Atom:
+		if n.Token.Kind != token.Ident {
+			return n
+		}
+
+		// Global functions are constant, nested ones are created at runtime
+		if fn, ok := n.Defined.(*node.Fn); ok && fn.Parent == nil {
+			return n
+		}
+
+	case *node.Fn:
+		// Function literals in the initializers of globals
+		if n.Parent == nil {
+			return n
+		}
+
+	case *node.Unary:
+		// The address of a global variable is constant
+		if n.Token.Kind == token.BAnd {
+			if atom, ok := n.Operand.(*node.Atom); ok {
+				if let, ok := atom.Defined.(*node.Let); ok && let.Kind == node.LetGlobal {
+					return n
+				}
+			}
+
+			return nil
+		}
+
+		if n.Type.IsFloat() {
+			operand, ok := constantFloat(evaluate(n.Operand))
+			if !ok || n.Token.Kind != token.Sub {
+				return nil
+			}
+
+			return constantNewFloat(n.Token, n.Type, -operand)
+		}
+
+		operand, ok := constantScalar(evaluate(n.Operand))
+		if !ok {
+			return nil
+		}
+
+		// @TokenKind
+		switch n.Token.Kind {
+		case token.Sub:
+			return constantNew(n.Token, n.Type, -operand)
+
+		case token.BNot:
+			return constantNew(n.Token, n.Type, ^operand)
+
+		case token.LNot:
+			return constantNew(n.Token, n.Type, operand^1)
+		}
+
+	case *node.Instance:
+		return evaluate(n.Fn)
+
+	case *node.Binary:
+		if n.Token.Kind == token.As {
+			return evaluateCast(n)
+		}
+
+		// Instances of generic functions
+		if lhsType := n.Lhs.GetType(); n.Token.Kind == token.LBracket && lhsType.Kind == node.TypeFn && lhsType.Ref == 0 {
+			return evaluate(n.Lhs)
+		}
+
+		// Variants of enums, and of unions without a payload
+		if n.Token.Kind == token.Dot {
+			if _, ok := n.Rhs.(*node.Atom).Defined.(*node.Struct); ok {
+				return n
+			}
+
+			variant, ok := n.Rhs.(*node.Atom).Defined.(*node.Let)
+			if !ok || variant.Kind != node.LetVariant {
+				return nil
+			}
+
+			value, ok := constantScalar(variant.Constant)
+			if !ok {
+				return nil
+			}
+
+			return constantNew(n.Lhs.Literal(), n.Type, value)
+		}
+
+		if n.Lhs.GetType().IsFloat() {
+			return evaluateFloat(n)
+		}
+
+		lhs, ok := constantScalar(evaluate(n.Lhs))
+		if !ok {
+			return nil
+		}
+
+		rhs, ok := constantScalar(evaluate(n.Rhs))
+		if !ok {
+			return nil
+		}
+
+		lhsType := n.Lhs.GetType()
+		signed := lhsType.IsSignedInt()
+
+		// @TokenKind
+		switch n.Token.Kind {
+		case token.Add:
+			return constantNew(n.Token, n.Type, lhs+rhs)
+
+		case token.Sub:
+			return constantNew(n.Token, n.Type, lhs-rhs)
+
+		case token.Mul:
+			return constantNew(n.Token, n.Type, lhs*rhs)
+
+		case token.Div, token.Mod:
+			if rhs == 0 {
+				return nil
+			}
+
+			if signed {
+				// The minimum value is the only one besides zero which is its own
+				// negation. Dividing it by -1 overflows
+				if int64(rhs) == -1 && lhs != 0 && constantNormalize(-lhs, n.Type) == lhs {
+					return nil
+				}
+
+				if n.Token.Kind == token.Mod {
+					return constantNew(n.Token, n.Type, uint64(int64(lhs)%int64(rhs)))
+				}
+
+				return constantNew(n.Token, n.Type, uint64(int64(lhs)/int64(rhs)))
+			}
+
+			if n.Token.Kind == token.Mod {
+				return constantNew(n.Token, n.Type, lhs%rhs)
+			}
+
+			return constantNew(n.Token, n.Type, lhs/rhs)
+
+		case token.Shl, token.Shr:
+			if rhs >= uint64(integerConversions[n.Type.Kind].bits) {
+				return nil
+			}
+
+			if n.Token.Kind == token.Shl {
+				return constantNew(n.Token, n.Type, lhs<<rhs)
+			}
+
+			if signed {
+				return constantNew(n.Token, n.Type, uint64(int64(lhs)>>rhs))
+			}
+
+			return constantNew(n.Token, n.Type, lhs>>rhs)
+
+		case token.BOr, token.LOr:
+			return constantNew(n.Token, n.Type, lhs|rhs)
+
+		case token.BAnd, token.LAnd:
+			return constantNew(n.Token, n.Type, lhs&rhs)
+
+		case token.BXor:
+			return constantNew(n.Token, n.Type, lhs^rhs)
+
+		case token.Gt, token.Ge, token.Lt, token.Le, token.Eq, token.Ne:
+			order := constantCompare(lhs, rhs, lhsType)
+
+			result := false
+			switch n.Token.Kind {
+			case token.Gt:
+				result = order > 0
+
+			case token.Ge:
+				result = order >= 0
+
+			case token.Lt:
+				result = order < 0
+
+			case token.Le:
+				result = order <= 0
+
+			case token.Eq:
+				result = order == 0
+
+			case token.Ne:
+				result = order != 0
+			}
+
+			value := uint64(0)
+			if result {
+				value = 1
+			}
+
+			return constantNew(n.Token, n.Type, value)
+		}
+
+	case *node.Intrinsic:
+		return evaluateIntrinsic(n)
+
+	case *node.Compound:
+		compound := *n
+		compound.Fields = []*node.Let{}
+
+		for _, field := range n.Fields {
+			assign := evaluate(field.Assign)
+			if assign == nil {
+				return nil
+			}
+
+			constant := *field
+			constant.Assign = assign
+			compound.Fields = append(compound.Fields, &constant)
+		}
+
+		return &compound
+	}
+
+	return nil
+}
+
+// @TokenKind
+func evaluateFloat(n *node.Binary) node.Node {
+	lhs, ok := constantFloat(evaluate(n.Lhs))
+	if !ok {
+		return nil
+	}
+
+	rhs, ok := constantFloat(evaluate(n.Rhs))
+	if !ok {
+		return nil
+	}
+
+	switch n.Token.Kind {
+	case token.Add:
+		return constantNewFloat(n.Token, n.Type, lhs+rhs)
+
+	case token.Sub:
+		return constantNewFloat(n.Token, n.Type, lhs-rhs)
+
+	case token.Mul:
+		return constantNewFloat(n.Token, n.Type, lhs*rhs)
+
+	case token.Div:
+		return constantNewFloat(n.Token, n.Type, lhs/rhs)
+	}
+
+	// Comparisons with NaN are false, except for '!='
+	result := false
+	switch n.Token.Kind {
+	case token.Gt:
+		result = lhs > rhs
+
+	case token.Ge:
+		result = lhs >= rhs
+
+	case token.Lt:
+		result = lhs < rhs
+
+	case token.Le:
+		result = lhs <= rhs
+
+	case token.Eq:
+		result = lhs == rhs
+
+	case token.Ne:
+		result = lhs != rhs
+
+	default:
+		return nil
+	}
+
+	value := uint64(0)
+	if result {
+		value = 1
+	}
+
+	return constantNew(n.Token, n.Type, value)
+}
+
+// @TypeKind
+func evaluateCast(n *node.Binary) node.Node {
+	from := n.Lhs.GetType().Underlying()
+	to := n.Type.Underlying()
+
+	// Only numbers and booleans, pointers are only known after linking
+	for _, t := range []node.Type{from, to} {
+		if t.Ref != 0 || (t.Kind != node.TypeBool && !typeKindIsInteger(t.Kind) && !t.IsFloat()) {
+			return nil
+		}
+	}
+
+	if from.IsFloat() {
+		value, ok := constantFloat(evaluate(n.Lhs))
+		if !ok {
+			return nil
+		}
+
+		if to.IsFloat() {
+			return constantNewFloat(n.Token, to, value)
+		}
+
+		// Values which do not fit within the integer are poison in LLVM
+		size := float64(integerConversions[to.Kind].bits)
+		value = math.Trunc(value)
+		if to.IsSignedInt() {
+			limit := math.Exp2(size - 1)
+			if !(value >= -limit && value < limit) {
+				return nil
+			}
+
+			return constantNew(n.Token, to, uint64(int64(value)))
+		}
+
+		if !(value >= 0 && value < math.Exp2(size)) {
+			return nil
+		}
+
+		return constantNew(n.Token, to, uint64(value))
+	}
+
+	value, ok := constantScalar(evaluate(n.Lhs))
+	if !ok {
+		return nil
+	}
+
+	if to.IsFloat() {
+		if from.IsSignedInt() {
+			return constantNewFloat(n.Token, to, float64(int64(value)))
+		}
+
+		return constantNewFloat(n.Token, to, float64(value))
+	}
+
+	if to.Kind == node.TypeBool && value != 0 {
+		value = 1
+	}
+
+	// Values which are not a variant are left to be checked at runtime
+	if n.Type.Kind == node.TypeEnum && n.Type.Ref == 0 && !enumHasValue(n.Type.Spec.(*node.Enum), value, from) {
+		return nil
+	}
+
+	return constantNew(n.Token, n.Type, value)
+}
+
+// @TokenKind
+func evaluateIntrinsic(n *node.Intrinsic) node.Node {
+	if typeIsError(n.Type) {
+		return nil
+	}
+
+	args := []uint64{}
+	for _, arg := range n.Args {
+		value, ok := constantScalar(evaluate(arg))
+		if !ok {
+			return nil
+		}
+
+		args = append(args, value)
+	}
+
+	size := integerConversions[n.Type.Kind].bits
+	value := args[0] & (^uint64(0) >> (64 - size))
+
+	switch n.Token.Kind {
+	case token.Popcount:
+		return constantNew(n.Token, n.Type, uint64(bits.OnesCount64(value)))
+
+	case token.Clz:
+		return constantNew(n.Token, n.Type, uint64(bits.LeadingZeros64(value)-(64-size)))
+
+	case token.Ctz:
+		return constantNew(n.Token, n.Type, uint64(min(bits.TrailingZeros64(value), size)))
+
+	case token.Bswap:
+		return constantNew(n.Token, n.Type, bits.ReverseBytes64(value)>>(64-size))
+
+	case token.Rotl, token.Rotr:
+		// The amount is taken modulo the size, like the LLVM funnel shifts
+		amount := int(args[1] % uint64(size))
+		if n.Token.Kind == token.Rotr {
+			amount = (size - amount) % size
+		}
+
+		return constantNew(n.Token, n.Type, value<<amount|value>>(size-amount))
+	}
+
+	return nil
+}
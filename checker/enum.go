@@ -0,0 +1,115 @@
+package checker
+
+import "yozi/node"
+
+func (c *Context) checkEnum(n *node.Enum) {
+	n.Type = node.Type{Kind: node.TypeEnum, Spec: n}
+	if previous, ok := c.Globals[n.Token.Str]; ok {
+		c.errorRedefinition(n, previous, "global identifier")
+	} else {
+		c.globalDefine(n)
+	}
+
+	if n.DefType != nil {
+		c.checkType(n.DefType)
+		if typeIsError(c.typeAssertInteger(n.DefType)) {
+			n.DefType = nil
+		}
+	}
+
+	base := n.BaseType()
+	for i, variant := range n.Variants {
+		for _, previous := range n.Variants[:i] {
+			if previous.Token.Str == variant.Token.Str {
+				c.errorRedefinition(variant, previous, "variant")
+				break
+			}
+		}
+
+		variant.Type = n.Type
+
+		// Variants without an explicit value follow the previous one
+		value := uint64(0)
+		if variant.Assign != nil {
+			c.Check(variant.Assign)
+			c.typeAssert(&variant.Assign, base)
+
+			constant, ok := constantScalar(evaluate(variant.Assign))
+			if !ok {
+				if !typeIsError(variant.Assign.GetType()) {
+					c.sink.Error(nodeStart(variant.Assign), "Expected constant value for variant")
+				}
+				continue
+			}
+
+			value = constant
+		} else if i != 0 {
+			previous, ok := constantScalar(n.Variants[i-1].Constant)
+			if !ok {
+				continue
+			}
+
+			value = constantNormalize(previous+1, base)
+			if constantCompare(value, previous, base) <= 0 {
+				c.sink.Error(variant.Token.Pos, "Value of variant '%s' overflows type %s", variant.Token.Str, base)
+				continue
+			}
+		}
+
+		for _, previous := range n.Variants[:i] {
+			if other, ok := constantScalar(previous.Constant); ok && other == value {
+				c.sink.Error(variant.Token.Pos, "Duplicate value of variant '%s'", variant.Token.Str).
+					Note(previous.Token.Pos, "Same value as '%s'", previous.Token.Str)
+				break
+			}
+		}
+
+		variant.Constant = constantNew(variant.Token, n.Type, value)
+	}
+}
+
+// Color.Red
+func (c *Context) checkVariant(n *node.Binary, e *node.Enum) {
+	lhs := n.Lhs.(*node.Atom)
+	lhs.Defined = e
+	lhs.Type = e.Type
+
+	rhs := n.Rhs.(*node.Atom)
+	index := e.Find(rhs.Token.Str)
+	if index == -1 {
+		c.errorUndefined(rhs, "variant")
+		n.Type = typeError()
+		return
+	}
+
+	rhs.Defined = e.Variants[index]
+	rhs.Type = e.Type
+	n.Type = e.Type
+}
+
+// Whether the integer constant is the value of a variant of the enum
+func enumHasValue(e *node.Enum, value uint64, t node.Type) bool {
+	for _, variant := range e.Variants {
+		if constant, ok := constantScalar(variant.Constant); ok {
+			if constantBig(constant, e.Type).Cmp(constantBig(value, t)) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// 69 as Color. Only constants are checked, other values are checked at runtime
+// in debug builds
+func (c *Context) checkVariantCast(n *node.Binary) {
+	from := n.Lhs.GetType()
+	if n.Type.Kind != node.TypeEnum || n.Type.Ref != 0 || from.Kind == node.TypeEnum {
+		return
+	}
+
+	value, ok := constantScalar(n.Lhs)
+	if ok && !enumHasValue(n.Type.Spec.(*node.Enum), value, from) {
+		c.sink.Error(nodeStart(n.Lhs), "Constant %s is not a variant of %s", constantBig(value, from), n.Type)
+	}
+}
@@ -0,0 +1,312 @@
+package checker
+
+import (
+	"slices"
+	"strings"
+	"yozi/node"
+	"yozi/token"
+)
+
+// Instances which instantiate other generic functions beyond this depth are
+// most likely instantiating infinitely many of them
+const instanceDepthMax = 16
+
+// fn max[T](a T, b T) T
+func (c *Context) checkGeneric(n *node.Fn) {
+	if previous, ok := c.Globals[n.Token.Str]; ok {
+		c.errorRedefinition(n, previous, "global identifier")
+	} else {
+		c.globalDefine(n)
+	}
+
+	for i, param := range n.Generics {
+		for _, previous := range n.Generics[:i] {
+			if previous.Str == param.Str {
+				c.sink.Error(param.Pos, "Redefinition of type parameter '%s'", param.Str).
+					Note(previous.Pos, "Defined here")
+				break
+			}
+		}
+	}
+
+	// The body is only checked once the types are known
+	n.Type = node.Type{Kind: node.TypeFn, Spec: n}
+}
+
+// Returns the generic function which the expression names, if any
+func (c *Context) genericFind(n node.Node) *node.Fn {
+	atom, ok := n.(*node.Atom)
+	if !ok || atom.Token.Kind != token.Ident {
+		return nil
+	}
+
+	if defined, ok := c.variableFind(atom.Token.Str); ok {
+		if fn, ok := defined.(*node.Fn); ok && fn.Generics != nil {
+			return fn
+		}
+	}
+
+	return nil
+}
+
+// Returns the type which a type parameter of the instance being checked is
+// bound to
+func (c *Context) typeArgFind(name string) (node.Type, bool) {
+	if c.instance == nil {
+		return node.Type{}, false
+	}
+
+	for i, param := range c.instance.Generic.Generics {
+		if param.Str == name {
+			return c.instance.TypeArgs[i], true
+		}
+	}
+
+	return node.Type{}, false
+}
+
+// Whether the expression is also a valid type, like i64 or &Point
+func nodeIsTypeSyntax(n node.Node) bool {
+	switch n := n.(type) {
+	case *node.Atom:
+		return n.Token.Kind == token.Ident
+
+	case *node.Unary:
+		return n.Token.Kind == token.BAnd && nodeIsTypeSyntax(n.Operand)
+
+	case *node.Array:
+		return true
+
+	case *node.Fn:
+		// Function types have no body, unlike function literals
+		return n.Body == nil
+
+	default:
+		return false
+	}
+}
+
+// Returns the instance of the generic function with the types, checking it if
+// it was not instantiated with them before. Errors within the instance are
+// also pointed at the position it was first instantiated from
+func (c *Context) instantiate(generic *node.Fn, typeArgs []node.Type, pos token.Pos) *node.Fn {
+	for _, instance := range generic.Instances {
+		if slices.EqualFunc(instance.TypeArgs, typeArgs, node.Type.Equal) {
+			return instance
+		}
+	}
+
+	names := make([]string, len(typeArgs))
+	for i, t := range typeArgs {
+		names[i] = t.String()
+	}
+
+	instance := node.Clone(generic).(*node.Fn)
+	instance.Token.Str += "[" + strings.Join(names, ", ") + "]"
+
+	if c.instanceDepth == instanceDepthMax {
+		c.sink.Error(pos, "Instantiation of '%s' is nested too deeply", instance.Token.Str)
+		return nil
+	}
+
+	instance.Generics = nil
+	instance.Generic = generic
+	instance.TypeArgs = typeArgs
+	instance.Type = node.Type{Kind: node.TypeFn, Spec: instance}
+
+	// Recursive instantiations refer to the instance being checked
+	generic.Instances = append(generic.Instances, instance)
+	c.Ordered = append(c.Ordered, instance)
+
+	// Instances are checked like global functions, regardless of where they
+	// are instantiated from
+	locals := c.locals
+	fnScopes := c.fnScopes
+	flows := c.flows
+	previous := c.instance
+
+	c.locals = nil
+	c.fnScopes = nil
+	c.flows = nil
+	c.instance = instance
+	c.instanceDepth++
+	{
+		start := len(c.sink.Diagnostics)
+		c.checkFnBody(instance)
+
+		for _, d := range c.sink.Diagnostics[start:] {
+			d.Note(pos, "Instantiated as '%s' here", instance.Token.Str)
+		}
+	}
+	c.instanceDepth--
+	c.instance = previous
+	c.flows = flows
+	c.fnScopes = fnScopes
+	c.locals = locals
+
+	return instance
+}
+
+// Refers the name of the generic function to the instance
+func (c *Context) instanceUse(n *node.Atom, instance *node.Fn) {
+	n.Defined = instance
+	n.Type = instance.Type
+}
+
+// max[i64]
+// max[i64, u8]
+func (c *Context) checkInstance(n node.Node, fn node.Node, args []node.Node) {
+	generic := c.genericFind(fn)
+	if generic == nil {
+		c.Check(fn)
+		if fnType := fn.GetType(); !typeIsError(fnType) {
+			c.sink.Error(nodeStart(fn), "Expected generic function, got %s", fnType)
+		}
+
+		n.SetType(typeError())
+		return
+	}
+
+	valid := true
+	typeArgs := make([]node.Type, len(args))
+	for i, arg := range args {
+		if !nodeIsTypeSyntax(arg) {
+			c.sink.Error(nodeStart(arg), "Expected type")
+			valid = false
+			continue
+		}
+
+		c.checkType(arg)
+		typeArgs[i] = arg.GetType()
+		valid = valid && !typeIsError(typeArgs[i])
+	}
+
+	if len(args) != len(generic.Generics) {
+		c.sink.Error(n.Literal().Pos, "Expected %d type arguments, got %d", len(generic.Generics), len(args))
+		valid = false
+	}
+
+	var instance *node.Fn
+	if valid {
+		instance = c.instantiate(generic, typeArgs, n.Literal().Pos)
+	}
+
+	if instance == nil {
+		fn.SetType(typeError())
+		n.SetType(typeError())
+		return
+	}
+
+	c.instanceUse(fn.(*node.Atom), instance)
+	n.SetType(instance.Type)
+}
+
+// Binds the type parameters which appear in the type of an argument, by
+// matching it against the type of the value passed. Parameters which are
+// already bound are left as is
+func inferTypes(generic *node.Fn, param node.Node, t node.Type, typeArgs []node.Type) {
+	switch param := param.(type) {
+	case *node.Atom:
+		for i, name := range generic.Generics {
+			if name.Str == param.Token.Str && typeIsError(typeArgs[i]) {
+				typeArgs[i] = t
+			}
+		}
+
+	case *node.Unary:
+		if t.Ref != 0 {
+			t.Ref--
+			inferTypes(generic, param.Operand, t, typeArgs)
+		}
+
+	case *node.Array:
+		if t.Ref != 0 {
+			break
+		}
+
+		if param.Length == nil && t.Kind == node.TypeSlice || param.Length != nil && t.Kind == node.TypeArray {
+			inferTypes(generic, param.Item, t.Spec.(*node.Array).Item.GetType(), typeArgs)
+		}
+
+	case *node.Fn:
+		if t.Kind != node.TypeFn || t.Ref != 0 {
+			break
+		}
+
+		sig := t.Spec.(*node.Fn)
+		for i, arg := range param.Args {
+			if i < len(sig.Args) {
+				inferTypes(generic, arg.DefType, sig.Args[i].Type, typeArgs)
+			}
+		}
+
+		if param.Return != nil {
+			inferTypes(generic, param.Return, sig.ReturnType(), typeArgs)
+		}
+	}
+}
+
+// max(1, 2). The type arguments are inferred from the arguments. Returns false
+// if the call is not of a generic function
+func (c *Context) checkGenericCall(n *node.Call) bool {
+	generic := c.genericFind(n.Fn)
+	if generic == nil {
+		return false
+	}
+
+	if len(n.Args) != len(generic.Args) {
+		c.sink.Error(n.Token.Pos, "Expected %d arguments, got %d", len(generic.Args), len(n.Args))
+	}
+
+	typeArgs := make([]node.Type, len(generic.Generics))
+	for i := range typeArgs {
+		typeArgs[i] = typeError()
+	}
+
+	// Untyped constants only decide the types which nothing else does, so
+	// that max(x, 1) works for any integer x
+	inferable := true
+	for i := range n.Args {
+		c.Check(n.Args[i])
+		if typeIsError(n.Args[i].GetType()) {
+			inferable = false
+		} else if i < len(generic.Args) && !typeIsUntyped(n.Args[i]) {
+			inferTypes(generic, generic.Args[i].DefType, n.Args[i].GetType(), typeArgs)
+		}
+	}
+
+	for i, arg := range n.Args {
+		if i < len(generic.Args) && typeIsUntyped(arg) {
+			inferTypes(generic, generic.Args[i].DefType, arg.GetType(), typeArgs)
+		}
+	}
+
+	var instance *node.Fn
+	if index := slices.IndexFunc(typeArgs, typeIsError); index != -1 {
+		if inferable {
+			c.sink.Error(n.Token.Pos, "Cannot infer type parameter '%s' of '%s'", generic.Generics[index].Str, generic.Token.Str).
+				Note(generic.Generics[index].Pos, "Defined here")
+		}
+	} else {
+		instance = c.instantiate(generic, typeArgs, n.Token.Pos)
+	}
+
+	if instance == nil {
+		n.Fn.SetType(typeError())
+		n.Type = typeError()
+		return true
+	}
+
+	c.instanceUse(n.Fn.(*node.Atom), instance)
+	for i := range n.Args {
+		if i < len(instance.Args) {
+			c.typeAssert(&n.Args[i], instance.Args[i].Type)
+			c.flowArg(n.Args[i], instance.Args[i])
+		} else {
+			c.typeDefault(&n.Args[i])
+		}
+	}
+
+	n.Type = instance.ReturnType()
+	return true
+}
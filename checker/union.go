@@ -0,0 +1,251 @@
+package checker
+
+import (
+	"strings"
+	"yozi/node"
+	"yozi/token"
+)
+
+func (c *Context) checkUnion(n *node.Union) {
+	n.Type = node.Type{Kind: node.TypeUnion, Spec: n}
+	if previous, ok := c.Globals[n.Token.Str]; ok {
+		c.errorRedefinition(n, previous, "global identifier")
+	} else {
+		c.globalDefine(n)
+	}
+
+	for i, variant := range n.Variants {
+		for _, previous := range n.Variants[:i] {
+			if previous.Token.Str == variant.Token.Str {
+				c.errorRedefinition(variant, previous, "variant")
+				break
+			}
+		}
+
+		variant.Type = n.Type
+		for j, field := range variant.Fields {
+			for _, previous := range variant.Fields[:j] {
+				if previous.Token.Str == field.Token.Str {
+					c.errorRedefinition(field, previous, "field")
+					break
+				}
+			}
+
+			c.checkType(field.DefType)
+			field.Type = field.DefType.GetType()
+
+			if typeContains(field.Type, n.Type) {
+				c.sink.Error(field.DefType.Literal().Pos, "Union %s cannot contain itself", n.Type)
+			}
+		}
+	}
+}
+
+// Temporaries live in the stack frame of the current function, or of the
+// function which initializes the globals
+func (c *Context) tempNew(tok token.Token, t node.Type) *node.Let {
+	temp := &node.Let{Token: tok, Kind: node.LetLocal, Type: t}
+	if c.currentFn != nil {
+		c.currentFn.Locals = append(c.currentFn.Locals, temp)
+	} else {
+		c.Temps = append(c.Temps, temp)
+	}
+
+	return temp
+}
+
+// Shape.Circle
+func (c *Context) checkUnionVariant(n *node.Binary, u *node.Union) *node.Struct {
+	lhs := n.Lhs.(*node.Atom)
+	lhs.Defined = u
+	lhs.Type = u.Type
+
+	rhs := n.Rhs.(*node.Atom)
+	index := u.Find(rhs.Token.Str)
+	if index == -1 {
+		c.errorUndefined(rhs, "variant")
+		n.Type = typeError()
+		return nil
+	}
+
+	rhs.Defined = u.Variants[index]
+	rhs.Type = u.Type
+	n.Type = u.Type
+	return u.Variants[index]
+}
+
+// Returns the union and the access of the variant which the call constructs,
+// if any
+func (c *Context) variantFind(n *node.Call) (*node.Union, *node.Binary) {
+	access, ok := n.Fn.(*node.Binary)
+	if !ok || access.Token.Kind != token.Dot {
+		return nil, nil
+	}
+
+	u, ok := c.typeNameFind(access.Lhs).(*node.Union)
+	if !ok {
+		return nil, nil
+	}
+
+	return u, access
+}
+
+// Shape.Circle(69). Returns false if the call is not a construction
+func (c *Context) checkConstruction(n *node.Call) bool {
+	u, access := c.variantFind(n)
+	if u == nil {
+		return false
+	}
+
+	variant := c.checkUnionVariant(access, u)
+	if variant == nil {
+		for _, arg := range n.Args {
+			c.Check(arg)
+		}
+
+		n.Type = typeError()
+		return true
+	}
+
+	if len(n.Args) != len(variant.Fields) {
+		c.sink.Error(n.Token.Pos, "Expected %d arguments, got %d", len(variant.Fields), len(n.Args))
+	}
+
+	for i := range n.Args {
+		c.Check(n.Args[i])
+		if i < len(variant.Fields) {
+			c.typeAssert(&n.Args[i], variant.Fields[i].Type)
+			c.flowAdd(n.Args[i], nil, nil)
+		} else {
+			c.typeDefault(&n.Args[i])
+		}
+	}
+
+	n.Type = u.Type
+	n.Temp = c.tempNew(n.Token, u.Type)
+	return true
+}
+
+// Checks a pattern of a union, which is a variant optionally followed by the
+// names which its payload fields are bound to. Returns the index of the variant
+func (c *Context) checkUnionPattern(arm *node.MatchArm, pattern node.Node, u *node.Union) (int, bool) {
+	var access *node.Binary
+	var bindings []node.Node
+
+	switch pattern := pattern.(type) {
+	case *node.Binary:
+		if pattern.Token.Kind == token.Dot {
+			access = pattern
+		}
+
+	case *node.Call:
+		access, _ = pattern.Fn.(*node.Binary)
+		if access != nil && access.Token.Kind != token.Dot {
+			access = nil
+		}
+
+		bindings = pattern.Args
+		if bindings == nil {
+			bindings = []node.Node{}
+		}
+	}
+
+	if access == nil || c.typeNameFind(access.Lhs) != u {
+		c.sink.Error(nodeStart(pattern), "Expected variant of %s", u.Type)
+		return 0, false
+	}
+
+	variant := c.checkUnionVariant(access, u)
+	if variant == nil {
+		return 0, false
+	}
+
+	// The payload does not have to be bound
+	if bindings == nil {
+		return u.Find(variant.Token.Str), true
+	}
+
+	if len(arm.Patterns) != 1 {
+		c.sink.Error(nodeStart(pattern), "Cannot bind payload in match arm with multiple patterns")
+		return 0, false
+	}
+
+	if len(bindings) != len(variant.Fields) {
+		c.sink.Error(pattern.Literal().Pos, "Expected %d fields, got %d", len(variant.Fields), len(bindings))
+		return 0, false
+	}
+
+	for i, binding := range bindings {
+		atom, ok := binding.(*node.Atom)
+		if !ok || atom.Token.Kind != token.Ident {
+			c.sink.Error(nodeStart(binding), "Expected identifier to bind field '%s' to", variant.Fields[i].Token.Str)
+			return 0, false
+		}
+
+		for _, previous := range arm.Bindings {
+			if previous.Token.Str == atom.Token.Str {
+				c.errorRedefinition(atom, previous, "local variable")
+				break
+			}
+		}
+
+		let := &node.Let{Token: atom.Token, Kind: node.LetLocal, Type: variant.Fields[i].Type}
+		c.currentFn.Locals = append(c.currentFn.Locals, let)
+		arm.Bindings = append(arm.Bindings, let)
+	}
+
+	return u.Find(variant.Token.Str), true
+}
+
+// The patterns are replaced with the tags of their variants
+func (c *Context) checkUnionArms(n *node.Match, u *node.Union) {
+	if !n.Subject.IsMemory() {
+		n.Temp = c.tempNew(n.Token, u.Type)
+	} else {
+		forceMemory(n.Subject)
+	}
+
+	// The patterns which matched each variant
+	covered := make([]node.Node, len(u.Variants))
+
+	// The patterns which were rejected could have covered any variant, so the
+	// exhaustiveness is not reported on top of them
+	rejected := false
+
+	for _, arm := range n.Arms {
+		for i, pattern := range arm.Patterns {
+			index, ok := c.checkUnionPattern(arm, pattern, u)
+			if !ok {
+				rejected = true
+				continue
+			}
+
+			if previous := covered[index]; previous != nil {
+				c.sink.Error(nodeStart(pattern), "Duplicate pattern in match").
+					Note(nodeStart(previous), "Previously matched here")
+			} else {
+				covered[index] = pattern
+			}
+
+			arm.Patterns[i] = constantNew(pattern.Literal(), u.TagType(), uint64(index))
+		}
+	}
+
+	if n.Else != nil || rejected {
+		n.Exhaustive = true
+		return
+	}
+
+	missing := []string{}
+	for i, variant := range u.Variants {
+		if covered[i] == nil {
+			missing = append(missing, variant.Token.Str)
+		}
+	}
+
+	if len(missing) != 0 {
+		c.sink.Error(n.Token.Pos, "Match is not exhaustive, missing %s", strings.Join(missing, ", "))
+	}
+
+	n.Exhaustive = len(missing) == 0
+}
@@ -0,0 +1,270 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"yozi/node"
+	"yozi/token"
+)
+
+// C knows nothing about environments, so functions are passed to and returned
+// from extern functions as their code
+func llvmFormatExternType(t node.Type) string {
+	if t.Kind == node.TypeFn && t.Ref == 0 {
+		return "i8*"
+	}
+
+	return llvmFormatType(t)
+}
+
+func llvmFormatExternDecl(fn *node.Fn) string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "declare %s %s(", llvmFormatExternType(fn.ReturnType()), fn.Token.Str)
+	for i, arg := range fn.Args {
+		if i != 0 {
+			sb.WriteString(", ")
+		}
+
+		sb.WriteString(llvmFormatExternType(arg.Type))
+	}
+
+	if fn.Variadic {
+		if len(fn.Args) != 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("...")
+	}
+
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func llvmFormatReturnType(fn *node.Fn) string {
+	if fn.Extern {
+		return llvmFormatExternType(fn.ReturnType())
+	}
+
+	return llvmFormatType(fn.ReturnType())
+}
+
+// The type of the code of a function. Closures take their environment as the
+// first argument
+func llvmFormatFnCode(fn *node.Fn, env bool) string {
+	sb := strings.Builder{}
+	sb.WriteString(llvmFormatReturnType(fn))
+
+	args := []string{}
+	if env {
+		args = append(args, "i8*")
+	}
+
+	for _, arg := range fn.Args {
+		if fn.Extern {
+			args = append(args, llvmFormatExternType(arg.GetType()))
+		} else {
+			args = append(args, llvmFormatType(arg.GetType()))
+		}
+	}
+
+	if fn.Variadic {
+		args = append(args, "...")
+	}
+
+	fmt.Fprintf(&sb, " (%s)*", strings.Join(args, ", "))
+	return sb.String()
+}
+
+// The environment of a closure holds pointers to the captured variables
+func llvmFormatEnvironment(fn *node.Fn) string {
+	fields := make([]string, len(fn.Captures))
+	for i, capture := range fn.Captures {
+		fields[i] = llvmFormatType(capture.GetType()) + "*"
+	}
+
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
+// The value of a function which is not a closure, as a constant
+func llvmFormatFnValue(fn *node.Fn) string {
+	return fmt.Sprintf("{ i8* bitcast (%s %s to i8*), i8* null }", llvmFormatFnCode(fn, false), fn.Token.Str)
+}
+
+// Makes the variables captured by the current function available through the
+// pointers in its environment
+func (c *Compiler) environmentLoad(fn *node.Fn) {
+	if len(fn.Captures) == 0 {
+		return
+	}
+
+	envType := llvmFormatEnvironment(fn)
+	env := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = bitcast i8* %%env to %s*\n", env, envType)
+
+	for i, capture := range fn.Captures {
+		pointerType := llvmFormatType(capture.GetType()) + "*"
+
+		field := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 %d\n", field, envType, envType, env, i)
+
+		pointer := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", pointer, pointerType, pointerType, field)
+
+		switch capture := capture.(type) {
+		case *node.Let:
+			capture.Token.Str = pointer
+
+		case *node.Fn:
+			c.closures[capture] = pointer
+
+		default:
+			panic("unreachable")
+		}
+	}
+}
+
+// Creates the value of a nested function, along with its environment
+func (c *Compiler) closureStore(fn *node.Fn) {
+	value := llvmFormatFnValue(fn)
+	if len(fn.Captures) != 0 {
+		value = fmt.Sprintf("{ i8* bitcast (%s %s to i8*), i8* null }", llvmFormatFnCode(fn, true), fn.Token.Str)
+
+		envType := llvmFormatEnvironment(fn)
+		env := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = alloca %s\n", env, envType)
+
+		for i, capture := range fn.Captures {
+			pointer := ""
+			switch capture := capture.(type) {
+			case *node.Let:
+				pointer = capture.Token.Str
+
+			case *node.Fn:
+				pointer = c.closures[capture]
+
+			default:
+				panic("unreachable")
+			}
+
+			pointerType := llvmFormatType(capture.GetType()) + "*"
+
+			field := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 %d\n", field, envType, envType, env, i)
+			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", pointerType, pointer, pointerType, field)
+		}
+
+		raw := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = bitcast %s* %s to i8*\n", raw, envType, env)
+
+		closure := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = insertvalue { i8*, i8* } %s, i8* %s, 1\n", closure, value, raw)
+		value = closure
+	}
+
+	fmt.Fprintf(c.out, "    store { i8*, i8* } %s, { i8*, i8* }* %s\n", value, c.closures[fn])
+}
+
+// Returns the value of the function which is referenced directly
+func (c *Compiler) fnValue(fn *node.Fn, ref bool) string {
+	slot, ok := c.closures[fn]
+	if !ok {
+		return llvmFormatFnValue(fn)
+	}
+
+	if ref {
+		return slot
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load { i8*, i8* }, { i8*, i8* }* %s\n", result, slot)
+	return result
+}
+
+// Functions are equal if both their code and environment are
+func (c *Compiler) fnCompareOp(n *node.Binary, op string) string {
+	lhs := c.compileExpr(n.Lhs, false)
+	rhs := c.compileExpr(n.Rhs, false)
+
+	results := [2]string{}
+	for i := range results {
+		lhsField := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, %d\n", lhsField, lhs, i)
+
+		rhsField := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, %d\n", rhsField, rhs, i)
+
+		results[i] = c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp %s i8* %s, %s\n", results[i], op, lhsField, rhsField)
+	}
+
+	combine := "and"
+	if op == "ne" {
+		combine = "or"
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = %s i1 %s, %s\n", result, combine, results[0], results[1])
+	return result
+}
+
+// Calls a function value, passing the environment if it is a closure
+func (c *Compiler) closureCall(fn string, fnSig *node.Fn, args []string, pos token.Pos) string {
+	code := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, 0\n", code, fn)
+	c.nullCheck(code, node.Type{Kind: node.TypeRawptr}, pos)
+
+	env := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, 1\n", env, fn)
+
+	closure := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = icmp ne i8* %s, null\n", closure, env)
+
+	plainLabel := c.labelNew()
+	closureLabel := c.labelNew()
+	confluence := c.labelNew()
+	fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", closure, closureLabel, plainLabel)
+
+	fmt.Fprintf(c.out, "%s:\n", plainLabel)
+	plain := c.callOp(code, fnSig, false, args)
+	fmt.Fprintf(c.out, "    br label %%%s\n", confluence)
+
+	fmt.Fprintf(c.out, "%s:\n", closureLabel)
+	withEnv := c.callOp(code, fnSig, true, append([]string{"i8* " + env}, args...))
+	fmt.Fprintf(c.out, "    br label %%%s\n", confluence)
+
+	fmt.Fprintf(c.out, "%s:\n", confluence)
+	if plain == "" {
+		return ""
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(
+		c.out,
+		"    %s = phi %s [%s, %%%s], [%s, %%%s]\n",
+		result,
+		llvmFormatReturnType(fnSig),
+		plain,
+		plainLabel,
+		withEnv,
+		closureLabel,
+	)
+	return result
+}
+
+// Calls the code of a function, which is a raw pointer
+func (c *Compiler) callOp(code string, fnSig *node.Fn, env bool, args []string) string {
+	fnType := llvmFormatFnCode(fnSig, env)
+
+	fn := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = bitcast i8* %s to %s\n", fn, code, fnType)
+
+	result := ""
+
+	fmt.Fprint(c.out, "    ")
+	if !fnSig.ReturnType().Equal(node.Type{Kind: node.TypeUnit}) {
+		result = c.valueNew()
+		fmt.Fprintf(c.out, "%s = ", result)
+	}
+
+	fmt.Fprintf(c.out, "call %s %s(%s)\n", strings.TrimSuffix(fnType, "*"), fn, strings.Join(args, ", "))
+	return result
+}
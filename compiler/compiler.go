@@ -2,10 +2,13 @@ package compiler
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
 	"yozi/checker"
+	"yozi/diagnostic"
 	"yozi/node"
 	"yozi/token"
 )
@@ -13,9 +16,36 @@ import (
 type Compiler struct {
 	context *checker.Context
 
-	out     *os.File
+	out     *strings.Builder
 	labelId int
 	valueId int
+
+	strings   []string
+	stringIds map[string]int
+
+	// String literals of the program, which can be modified through slices.
+	// Each one has its own storage, unlike the strings of the compiler
+	literals []string
+
+	// The declarations of the LLVM intrinsics which are used
+	intrinsics map[string]string
+
+	// The loops enclosing the current statement, innermost last
+	loops []loop
+
+	// The pointers to the values of the nested functions which are in scope
+	closures map[*node.Fn]string
+
+	// Abort on integer overflow, division by zero and null pointer
+	// dereferences in the current function
+	debug bool
+}
+
+// The blocks which a continue and a break inside a loop branch to
+type loop struct {
+	node    node.Node
+	next    string
+	finally string
 }
 
 // @Temporary
@@ -38,25 +68,41 @@ func llvmFormatType(t node.Type) string {
 	case node.TypeI64, node.TypeU64:
 		sb.WriteString("i64")
 
+	case node.TypeF32:
+		sb.WriteString("float")
+
+	case node.TypeF64:
+		sb.WriteString("double")
+
 	case node.TypeUnit:
 		sb.WriteString("void")
 
 	case node.TypeFn:
-		fn := t.Spec.(*node.Fn)
-		sb.WriteString(llvmFormatType(fn.ReturnType()))
-		sb.WriteString(" (")
-		for i, arg := range fn.Args {
-			if i != 0 {
-				sb.WriteString(", ")
-			}
-
-			sb.WriteString(llvmFormatType(arg.GetType()))
-		}
-		sb.WriteString(")*")
+		// The code and the environment of closures, which is null for plain
+		// functions
+		sb.WriteString("{ i8*, i8* }")
 
 	case node.TypeRawptr:
 		sb.WriteString("i8*")
 
+	case node.TypeStruct:
+		sb.WriteString("%struct.")
+		sb.WriteString(t.Spec.Literal().Str)
+
+	case node.TypeEnum:
+		sb.WriteString(llvmFormatType(t.Spec.(*node.Enum).BaseType()))
+
+	case node.TypeUnion:
+		sb.WriteString("%union.")
+		sb.WriteString(t.Spec.Literal().Str)
+
+	case node.TypeArray:
+		array := t.Spec.(*node.Array)
+		fmt.Fprintf(&sb, "[%d x %s]", array.Count, llvmFormatType(array.Item.GetType()))
+
+	case node.TypeSlice:
+		fmt.Fprintf(&sb, "{ %s*, i64 }", llvmFormatType(t.Spec.(*node.Array).Item.GetType()))
+
 	default:
 		panic("unreachable")
 	}
@@ -68,6 +114,64 @@ func llvmFormatType(t node.Type) string {
 	return sb.String()
 }
 
+// @TypeKind
+func llvmFormatZero(t node.Type) string {
+	if t.Ref != 0 || t.Kind == node.TypeRawptr {
+		return "null"
+	}
+
+	if t.Kind == node.TypeStruct || t.Kind == node.TypeArray || t.Kind == node.TypeSlice || t.Kind == node.TypeFn || t.Kind == node.TypeUnion {
+		return "zeroinitializer"
+	}
+
+	if t.IsFloat() {
+		return "0.0"
+	}
+
+	return "0"
+}
+
+// Floats are written in hexadecimal, since LLVM only accepts decimals which
+// are exactly representable. Floats are also written as doubles
+func llvmFormatFloat(value float64) string {
+	return fmt.Sprintf("0x%016X", math.Float64bits(value))
+}
+
+func llvmFormatString(s string) string {
+	sb := strings.Builder{}
+	sb.WriteString("c\"")
+	for i := range len(s) {
+		ch := s[i]
+		if ch >= 32 && ch <= 126 && ch != '"' && ch != '\\' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "\\%02X", ch)
+		}
+	}
+	sb.WriteString("\\00\"")
+	return sb.String()
+}
+
+// @TypeKind
+func intSize(k node.TypeKind) int {
+	switch k {
+	case node.TypeI8, node.TypeU8:
+		return 8
+
+	case node.TypeI16, node.TypeU16:
+		return 16
+
+	case node.TypeI32, node.TypeU32:
+		return 32
+
+	case node.TypeI64, node.TypeU64:
+		return 64
+
+	default:
+		return -1
+	}
+}
+
 func (c *Compiler) valueNew() string {
 	c.valueId++
 	return fmt.Sprintf("%%%d", c.valueId-1)
@@ -78,6 +182,361 @@ func (c *Compiler) labelNew() string {
 	return fmt.Sprintf("L%d", c.labelId-1)
 }
 
+// Returns a constant expression which points to the null terminated string.
+// Identical strings share the same constant
+func (c *Compiler) stringNew(s string) string {
+	id, ok := c.stringIds[s]
+	if !ok {
+		id = len(c.strings)
+		c.strings = append(c.strings, s)
+		c.stringIds[s] = id
+	}
+
+	size := len(s) + 1
+	return fmt.Sprintf(
+		"getelementptr ([%d x i8], [%d x i8]* @.str.%d, i64 0, i64 0)",
+		size,
+		size,
+		id,
+	)
+}
+
+func (c *Compiler) literalNew(s string) string {
+	id := len(c.literals)
+	c.literals = append(c.literals, s)
+
+	size := len(s) + 1
+	return fmt.Sprintf(
+		"getelementptr ([%d x i8], [%d x i8]* @.literal.%d, i64 0, i64 0)",
+		size,
+		size,
+		id,
+	)
+}
+
+// Abort the program if the condition is true. The format and arguments are
+// passed to dprintf() as is
+func (c *Compiler) panicIf(condition string, pos token.Pos, format string, args ...string) {
+	failure := c.labelNew()
+	success := c.labelNew()
+
+	fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", condition, failure, success)
+	fmt.Fprintf(c.out, "%s:\n", failure)
+
+	message := c.stringNew(strings.ReplaceAll(pos.String(), "%", "%%") + ": ERROR: " + format + "\n")
+	fmt.Fprintf(c.out, "    %s = call i32 (i32, i8*, ...) @dprintf(i32 2, i8* %s", c.valueNew(), message)
+	for _, arg := range args {
+		fmt.Fprintf(c.out, ", %s", arg)
+	}
+	fmt.Fprintln(c.out, ")")
+
+	fmt.Fprintln(c.out, "    call void @exit(i32 1)")
+	fmt.Fprintln(c.out, "    unreachable")
+	fmt.Fprintf(c.out, "%s:\n", success)
+}
+
+// Abort the program if the pointer is null, in debug builds
+func (c *Compiler) nullCheck(pointer string, t node.Type, pos token.Pos) {
+	if !c.debug {
+		return
+	}
+
+	null := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = icmp eq %s %s, null\n", null, llvmFormatType(t), pointer)
+	c.panicIf(null, pos, "Null pointer dereference")
+}
+
+// Abort the program if the integer is not the value of any variant of the
+// enum, in debug builds
+func (c *Compiler) variantCheck(value string, t node.Type, e *node.Enum, pos token.Pos) {
+	if !c.debug {
+		return
+	}
+
+	llvmType := llvmFormatType(t)
+	bits := intSize(t.Kind)
+
+	found := "false"
+	for _, variant := range e.Variants {
+		constant := variant.Constant.(*node.Atom).Token.Int
+
+		// Variants which the integer cannot hold are never equal to it
+		literal := ""
+		if e.Type.IsSignedInt() && int64(constant) < 0 {
+			if !t.IsSignedInt() || bits < 64 && int64(constant) < int64(-1)<<(bits-1) {
+				continue
+			}
+
+			literal = strconv.FormatInt(int64(constant), 10)
+		} else {
+			if t.IsSignedInt() && constant >= 1<<(bits-1) || !t.IsSignedInt() && bits < 64 && constant >= 1<<bits {
+				continue
+			}
+
+			literal = strconv.FormatUint(constant, 10)
+		}
+
+		equal := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp eq %s %s, %s\n", equal, llvmType, value, literal)
+
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = or i1 %s, %s\n", result, found, equal)
+		found = result
+	}
+
+	invalid := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = xor i1 %s, true\n", invalid, found)
+	c.panicIf(invalid, pos, "Value is not a variant of "+e.Token.Str)
+}
+
+// C promotes variadic arguments smaller than int to int
+func (c *Compiler) variadicPromote(value string, t node.Type) string {
+	t = t.Underlying()
+	llvmType := llvmFormatType(t)
+	if t.Kind == node.TypeBool && t.Ref == 0 {
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = zext i1 %s to i32\n", result, value)
+		return "i32 " + result
+	}
+
+	if t.Kind == node.TypeF32 && t.Ref == 0 {
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = fpext float %s to double\n", result, value)
+		return "double " + result
+	}
+
+	if size := intSize(t.Kind); t.Ref == 0 && size != -1 && size < 32 {
+		command := "zext"
+		if t.IsSignedInt() {
+			command = "sext"
+		}
+
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = %s %s %s to i32\n", result, command, llvmType, value)
+		return "i32 " + result
+	}
+
+	return llvmType + " " + value
+}
+
+// Sign or zero extend an integer to 64 bits
+func (c *Compiler) extendInt(value string, t node.Type) string {
+	if intSize(t.Kind) == 64 {
+		return value
+	}
+
+	command := "zext"
+	if t.IsSignedInt() {
+		command = "sext"
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = %s %s %s to i64\n", result, command, llvmFormatType(t), value)
+	return result
+}
+
+// Returns the value of a slice, automatically dereferencing it
+func (c *Compiler) sliceValue(n node.Node, pos token.Pos) string {
+	value := c.compileExpr(n, false)
+
+	sliceType := n.GetType()
+	if sliceType.Ref != 0 {
+		c.nullCheck(value, sliceType, pos)
+
+		sliceType.Ref = 0
+		llvmSlice := llvmFormatType(sliceType)
+
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmSlice, llvmSlice, value)
+		value = result
+	}
+
+	return value
+}
+
+// Returns the pointer and length of a slice
+func (c *Compiler) sliceParts(slice string, sliceType node.Type) (string, string) {
+	sliceType.Ref = 0
+	llvmSlice := llvmFormatType(sliceType)
+
+	pointer := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue %s %s, 0\n", pointer, llvmSlice, slice)
+
+	length := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue %s %s, 1\n", length, llvmSlice, slice)
+	return pointer, length
+}
+
+func (c *Compiler) boundsCheck(index string, indexType node.Type, length string, pos token.Pos) {
+	outOfBounds := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = icmp uge i64 %s, %s\n", outOfBounds, index, length)
+
+	format := "Index %lu is out of bounds for length %lu"
+	if indexType.IsSignedInt() {
+		format = "Index %ld is out of bounds for length %lu"
+	}
+
+	c.panicIf(outOfBounds, pos, format, "i64 "+index, "i64 "+length)
+}
+
+func (c *Compiler) indexOp(n *node.Binary, ref bool) string {
+	if bounds, ok := n.Rhs.(*node.Binary); ok && bounds.Token.Kind == token.DotDot {
+		return c.sliceOp(n, bounds)
+	}
+
+	lhsType := n.Lhs.GetType()
+	indexType := n.Rhs.GetType()
+	llvmType := llvmFormatType(n.Type)
+
+	if lhsType.Kind == node.TypeSlice {
+		pointer, length := c.sliceParts(c.sliceValue(n.Lhs, n.Token.Pos), lhsType)
+
+		index := c.extendInt(c.compileExpr(n.Rhs, false), indexType)
+		c.boundsCheck(index, indexType, length, n.Token.Pos)
+
+		item := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i64 %s\n", item, llvmType, llvmType, pointer, index)
+		if ref {
+			return item
+		}
+
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmType, llvmType, item)
+		return result
+	}
+
+	array := lhsType.Spec.(*node.Array)
+	llvmArray := llvmFormatType(array.Type)
+
+	// Indices known at compile time are bounds checked by the checker
+	constant, isConstant := n.Rhs.(*node.Atom)
+	isConstant = isConstant && constant.Token.IsInteger()
+
+	var base string
+	if n.Memory {
+		// Arrays are automatically dereferenced
+		base = c.compileExpr(n.Lhs, lhsType.Ref == 0)
+		if lhsType.Ref != 0 {
+			c.nullCheck(base, lhsType, n.Token.Pos)
+		}
+	} else {
+		value := c.compileExpr(n.Lhs, false)
+		if isConstant {
+			result := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = extractvalue %s %s, %d\n", result, llvmArray, value, constant.Token.Int)
+			return result
+		}
+
+		base = n.Temp.Token.Str
+		fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmArray, value, llvmArray, base)
+	}
+
+	index := c.extendInt(c.compileExpr(n.Rhs, false), indexType)
+	if !isConstant {
+		c.boundsCheck(index, indexType, fmt.Sprint(array.Count), n.Token.Pos)
+	}
+
+	pointer := c.valueNew()
+	fmt.Fprintf(
+		c.out,
+		"    %s = getelementptr %s, %s* %s, i64 0, i64 %s\n",
+		pointer,
+		llvmArray,
+		llvmArray,
+		base,
+		index,
+	)
+
+	if ref {
+		return pointer
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmType, llvmType, pointer)
+	return result
+}
+
+func (c *Compiler) sliceOp(n *node.Binary, bounds *node.Binary) string {
+	lhsType := n.Lhs.GetType()
+	llvmItem := llvmFormatType(n.Type.Spec.(*node.Array).Item.GetType())
+
+	// The length of slices made from pointers is not known
+	pointer := ""
+	length := ""
+
+	switch lhsType.Kind {
+	case node.TypeArray:
+		array := lhsType.Spec.(*node.Array)
+		llvmArray := llvmFormatType(array.Type)
+
+		// Arrays are automatically dereferenced
+		base := c.compileExpr(n.Lhs, lhsType.Ref == 0)
+		pointer = c.valueNew()
+		fmt.Fprintf(
+			c.out,
+			"    %s = getelementptr %s, %s* %s, i64 0, i64 0\n",
+			pointer,
+			llvmArray,
+			llvmArray,
+			base,
+		)
+		length = fmt.Sprint(array.Count)
+
+	case node.TypeSlice:
+		pointer, length = c.sliceParts(c.sliceValue(n.Lhs, n.Token.Pos), lhsType)
+
+	default:
+		pointer = c.compileExpr(n.Lhs, false)
+	}
+
+	start := "0"
+	if bounds.Lhs != nil {
+		start = c.extendInt(c.compileExpr(bounds.Lhs, false), bounds.Lhs.GetType())
+	}
+
+	end := length
+	if bounds.Rhs != nil {
+		end = c.extendInt(c.compileExpr(bounds.Rhs, false), bounds.Rhs.GetType())
+	}
+
+	invalid := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = icmp ugt i64 %s, %s\n", invalid, start, end)
+
+	if length != "" {
+		outOfBounds := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp ugt i64 %s, %s\n", outOfBounds, end, length)
+
+		either := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = or i1 %s, %s\n", either, invalid, outOfBounds)
+		invalid = either
+
+		c.panicIf(
+			invalid,
+			bounds.Token.Pos,
+			"Slice %ld..%ld is out of bounds for length %lu",
+			"i64 "+start,
+			"i64 "+end,
+			"i64 "+length,
+		)
+	} else {
+		c.panicIf(invalid, bounds.Token.Pos, "Slice start %ld is greater than end %ld", "i64 "+start, "i64 "+end)
+	}
+
+	offset := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i64 %s\n", offset, llvmItem, llvmItem, pointer, start)
+
+	count := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = sub i64 %s, %s\n", count, end, start)
+
+	llvmSlice := llvmFormatType(n.Type)
+	partial := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = insertvalue %s undef, %s* %s, 0\n", partial, llvmSlice, llvmItem, offset)
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = insertvalue %s %s, i64 %s, 1\n", result, llvmSlice, partial, count)
+	return result
+}
+
 func (c *Compiler) binaryOp(n *node.Binary, op string) string {
 	lhs := c.compileExpr(n.Lhs, false)
 	rhs := c.compileExpr(n.Rhs, false)
@@ -87,12 +546,100 @@ func (c *Compiler) binaryOp(n *node.Binary, op string) string {
 	return result
 }
 
+// The operator applied by each compound assignment
+//
+// @TokenKind
+var compoundOps = map[token.Kind]token.Kind{
+	token.AddSet:  token.Add,
+	token.SubSet:  token.Sub,
+	token.MulSet:  token.Mul,
+	token.DivSet:  token.Div,
+	token.ModSet:  token.Mod,
+	token.ShlSet:  token.Shl,
+	token.ShrSet:  token.Shr,
+	token.BOrSet:  token.BOr,
+	token.BAndSet: token.BAnd,
+	token.BXorSet: token.BXor,
+}
+
+// @TokenKind
+func arithOpcode(kind token.Kind, t node.Type) string {
+	if t.IsFloat() {
+		switch kind {
+		case token.Add:
+			return "fadd"
+
+		case token.Sub:
+			return "fsub"
+
+		case token.Mul:
+			return "fmul"
+
+		case token.Div:
+			return "fdiv"
+
+		default:
+			panic("unreachable")
+		}
+	}
+
+	switch kind {
+	case token.Add:
+		return "add"
+
+	case token.Sub:
+		return "sub"
+
+	case token.Mul:
+		return "mul"
+
+	case token.Div:
+		if t.IsSignedInt() {
+			return "sdiv"
+		}
+		return "udiv"
+
+	case token.Mod:
+		if t.IsSignedInt() {
+			return "srem"
+		}
+		return "urem"
+
+	case token.Shl:
+		return "shl"
+
+	case token.Shr:
+		if t.IsSignedInt() {
+			return "ashr"
+		}
+		return "lshr"
+
+	case token.BOr:
+		return "or"
+
+	case token.BAnd:
+		return "and"
+
+	case token.BXor:
+		return "xor"
+
+	default:
+		panic("unreachable")
+	}
+}
+
 // Like binaryOp, but pointers are first cast to i64
 func (c *Compiler) binaryArithOp(n *node.Binary, op string) string {
 	lhs := c.compileExpr(n.Lhs, false)
 	rhs := c.compileExpr(n.Rhs, false)
+	return c.arithOp(op, n.Lhs.GetType(), lhs, rhs, n.Token.Pos)
+}
+
+func (c *Compiler) arithOp(op string, exprType node.Type, lhs string, rhs string, pos token.Pos) string {
+	if c.debug && exprType.Ref == 0 && intSize(exprType.Kind) != -1 {
+		return c.checkedArithOp(op, exprType, lhs, rhs, pos)
+	}
 
-	exprType := n.Lhs.GetType()
 	tempType := "i64"
 
 	llvmType := llvmFormatType(exprType)
@@ -128,6 +675,77 @@ func (c *Compiler) binaryArithOp(n *node.Binary, op string) string {
 	}
 }
 
+var overflowOpNames = map[string]string{
+	"add": "Addition",
+	"sub": "Subtraction",
+	"mul": "Multiplication",
+}
+
+// Like arithOp, but the program is aborted if the result overflows or the
+// divisor is zero
+func (c *Compiler) checkedArithOp(op string, exprType node.Type, lhs string, rhs string, pos token.Pos) string {
+	llvmType := llvmFormatType(exprType)
+	switch op {
+	case "add", "sub", "mul":
+		return c.overflowOp(op, exprType, lhs, rhs, pos, overflowOpNames[op])
+
+	case "sdiv", "udiv", "srem", "urem":
+		zero := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp eq %s %s, 0\n", zero, llvmType, rhs)
+		c.panicIf(zero, pos, "Division by zero")
+
+		if exprType.IsSignedInt() {
+			minusOne := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = icmp eq %s %s, -1\n", minusOne, llvmType, rhs)
+
+			if op == "srem" {
+				// The remainder is always 0, but the minimum divided by -1
+				// overflows, which LLVM leaves undefined for srem as well
+				divisor := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = select i1 %s, %s 1, %s %s\n", divisor, minusOne, llvmType, llvmType, rhs)
+				rhs = divisor
+			} else {
+				minimum := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = icmp eq %s %s, %d\n", minimum, llvmType, lhs, int64(-1)<<(intSize(exprType.Kind)-1))
+
+				overflow := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = and i1 %s, %s\n", overflow, minimum, minusOne)
+				c.panicIf(overflow, pos, "Division overflows type "+exprType.String())
+			}
+		}
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = %s %s %s, %s\n", result, op, llvmType, lhs, rhs)
+	return result
+}
+
+// Performs an arithmetic operation with the llvm.*.with.overflow intrinsics,
+// aborting the program if the result overflows
+func (c *Compiler) overflowOp(op string, exprType node.Type, lhs string, rhs string, pos token.Pos, name string) string {
+	llvmType := llvmFormatType(exprType)
+	pairType := fmt.Sprintf("{ %s, i1 }", llvmType)
+
+	sign := "u"
+	if exprType.IsSignedInt() {
+		sign = "s"
+	}
+
+	intrinsic := fmt.Sprintf("@llvm.%s%s.with.overflow.%s", sign, op, llvmType)
+	c.intrinsics[intrinsic] = fmt.Sprintf("declare %s %s(%s, %s)", pairType, intrinsic, llvmType, llvmType)
+
+	pair := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = call %s %s(%s %s, %s %s)\n", pair, pairType, intrinsic, llvmType, lhs, llvmType, rhs)
+
+	overflow := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue %s %s, 1\n", overflow, pairType, pair)
+	c.panicIf(overflow, pos, name+" overflows type "+exprType.String())
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = extractvalue %s %s, 0\n", result, pairType, pair)
+	return result
+}
+
 func (c *Compiler) binaryLogicalOp(n *node.Binary) string {
 	var shortCircuitValue int
 
@@ -172,9 +790,12 @@ func (c *Compiler) binaryLogicalOp(n *node.Binary) string {
 // @TypeKind
 func (c *Compiler) castOp(from node.Node, to node.Node) string {
 	fromExpr := c.compileExpr(from, false)
+	if e, ok := to.GetType().Spec.(*node.Enum); ok && to.GetType().Ref == 0 && from.GetType().Kind != node.TypeEnum {
+		c.variantCheck(fromExpr, from.GetType(), e, to.Literal().Pos)
+	}
 
-	toType := to.GetType()
-	fromType := from.GetType()
+	toType := to.GetType().Underlying()
+	fromType := from.GetType().Underlying()
 	if fromType.Equal(toType) {
 		return fromExpr
 	}
@@ -184,29 +805,41 @@ func (c *Compiler) castOp(from node.Node, to node.Node) string {
 	llvmTo := llvmFormatType(toType)
 	llvmFrom := llvmFormatType(fromType)
 
-	intSize := func(k node.TypeKind) int {
-		switch k {
-		case node.TypeI8, node.TypeU8:
-			return 8
-
-		case node.TypeI16, node.TypeU16:
-			return 16
-
-		case node.TypeI32, node.TypeU32:
-			return 32
-
-		case node.TypeI64, node.TypeU64:
-			return 64
-
-		default:
-			return -1
-		}
-	}
-
 	toIntSize := intSize(toType.Kind)
 	fromIntSize := intSize(fromType.Kind)
 
-	if fromType.Ref != 0 || fromType.Kind == node.TypeRawptr {
+	if fromType.IsFloat() {
+		if toType.IsFloat() {
+			// Float -> Float
+			if fromType.Kind == node.TypeF32 {
+				command = "fpext"
+			} else {
+				command = "fptrunc"
+			}
+		} else if toType.IsSignedInt() {
+			// Float -> Integer
+			command = "fptosi"
+		} else {
+			command = "fptoui"
+		}
+	} else if toType.IsFloat() {
+		// Integer -> Float
+		if fromType.IsSignedInt() {
+			command = "sitofp"
+		} else {
+			command = "uitofp"
+		}
+	} else if fromType.Kind == node.TypeFn && fromType.Ref == 0 {
+		// Function -> Rawptr, only the code is kept
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = extractvalue %s %s, 0\n", result, llvmFrom, fromExpr)
+		return result
+	} else if toType.Kind == node.TypeFn && toType.Ref == 0 {
+		// Rawptr -> Function
+		result := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = insertvalue %s { i8* undef, i8* null }, i8* %s, 0\n", result, llvmTo, fromExpr)
+		return result
+	} else if fromType.Ref != 0 || fromType.Kind == node.TypeRawptr {
 		if toType.Ref != 0 || toType.Kind == node.TypeRawptr {
 			// Pointer -> Pointer
 			command = "bitcast"
@@ -255,6 +888,61 @@ func (c *Compiler) castOp(from node.Node, to node.Node) string {
 	return result
 }
 
+// Compiles a value evaluated by the checker into an LLVM constant
+//
+// @NodeKind
+func (c *Compiler) compileConstant(n node.Node) string {
+	switch n := n.(type) {
+	case *node.Atom:
+		if n.Token.IsInteger() && n.Type.IsSignedInt() {
+			return fmt.Sprintf("%d", int64(n.Token.Int))
+		}
+
+		if n.Token.Kind == token.Ident {
+			if fn, ok := n.Defined.(*node.Fn); ok {
+				return llvmFormatFnValue(fn)
+			}
+
+			return n.Defined.Literal().Str
+		}
+
+		return c.compileExpr(n, false)
+
+	case *node.Fn:
+		return llvmFormatFnValue(n)
+
+	case *node.Unary:
+		// Address of a global variable
+		return n.Operand.(*node.Atom).Defined.Literal().Str
+
+	case *node.Binary:
+		// Variant of a union without a payload
+		u, index := unionVariant(n)
+		return llvmFormatVariantValue(u, index)
+
+	case *node.Compound:
+		s := n.Type.Spec.(*node.Struct)
+		if len(s.Fields) == 0 {
+			return "zeroinitializer"
+		}
+
+		values := make([]string, len(s.Fields))
+		for i, field := range s.Fields {
+			values[i] = llvmFormatType(field.Type) + " " + llvmFormatZero(field.Type)
+		}
+
+		for _, field := range n.Fields {
+			index := s.Find(field.Token.Str)
+			values[index] = llvmFormatType(field.Type) + " " + c.compileConstant(field.Assign)
+		}
+
+		return "{ " + strings.Join(values, ", ") + " }"
+
+	default:
+		panic("unreachable")
+	}
+}
+
 // @NodeKind
 func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 	switch n := n.(type) {
@@ -263,15 +951,22 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 			return fmt.Sprintf("%d", n.Token.Int)
 		}
 
+		if n.Token.IsFloat() {
+			return llvmFormatFloat(n.Token.Float)
+		}
+
 		// @TokenKind
 		switch n.Token.Kind {
 		case token.Bool:
 			return fmt.Sprintf("%d", n.Token.Int)
 
+		case token.String:
+			return fmt.Sprintf("{ i8* %s, i64 %d }", c.literalNew(n.Token.Str), len(n.Token.Str))
+
 		case token.Ident:
 			switch def := n.Defined.(type) {
 			case *node.Fn:
-				ref = true
+				return c.fnValue(def, ref)
 
 			case *node.Let:
 				if def.Kind == node.LetArg {
@@ -295,39 +990,79 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 		}
 
 	case *node.Call:
-		fn := c.compileExpr(n.Fn, false)
-		args := []string{}
-
-		for _, arg := range n.Args {
-			args = append(args, c.compileExpr(arg, false))
+		if n.Temp != nil {
+			return c.compileConstruction(n)
 		}
 
-		result := ""
+		fnType := n.Fn.GetType()
+		fnSig := fnType.Spec.(*node.Fn)
+
+		// Functions called by name are called directly, and are never null
+		direct := directFn(n.Fn)
+
+		fn := ""
+		if direct == nil {
+			fn = c.compileExpr(n.Fn, false)
+
+			// Pointers to functions are automatically dereferenced
+			if fnType.Ref != 0 {
+				c.nullCheck(fn, fnType, n.Token.Pos)
+
+				fnType.Ref = 0
+				llvmFn := llvmFormatType(fnType)
 
-		fmt.Fprint(c.out, "    ")
-		if !n.Type.Equal(node.Type{Kind: node.TypeUnit}) {
-			result = c.valueNew()
-			fmt.Fprintf(c.out, "%s = ", result)
+				result := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmFn, llvmFn, fn)
+				fn = result
+			}
 		}
 
-		fmt.Fprintf(c.out, "call %s(", llvmFormatType(n.Type))
+		args := []string{}
 		for i, arg := range n.Args {
-			if i != 0 {
-				fmt.Fprint(c.out, ", ")
+			value := c.compileExpr(arg, false)
+			argType := arg.GetType()
+
+			// Only the code of functions is passed to C
+			if fnSig.Extern && argType.Kind == node.TypeFn && argType.Ref == 0 {
+				code := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, 0\n", code, value)
+				args = append(args, "i8* "+code)
+			} else if i < len(fnSig.Args) {
+				args = append(args, llvmFormatType(argType)+" "+value)
+			} else {
+				args = append(args, c.variadicPromote(value, argType))
 			}
-
-			fmt.Fprint(c.out, llvmFormatType(arg.GetType()))
 		}
-		fmt.Fprintf(c.out, ") %s(", fn)
-		for i, arg := range args {
-			if i != 0 {
-				fmt.Fprint(c.out, ", ")
+
+		result := ""
+		if direct == nil {
+			result = c.closureCall(fn, fnSig, args, n.Token.Pos)
+		} else {
+			if len(direct.Captures) != 0 {
+				closure := c.fnValue(direct, false)
+
+				env := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = extractvalue { i8*, i8* } %s, 1\n", env, closure)
+				args = append([]string{"i8* " + env}, args...)
 			}
 
-			fmt.Fprintf(c.out, "%s %s", llvmFormatType(n.Args[i].GetType()), arg)
+			fmt.Fprint(c.out, "    ")
+			if !n.Type.Equal(node.Type{Kind: node.TypeUnit}) {
+				result = c.valueNew()
+				fmt.Fprintf(c.out, "%s = ", result)
+			}
+
+			fnCode := llvmFormatFnCode(direct, len(direct.Captures) != 0)
+			fmt.Fprintf(c.out, "call %s %s(%s)\n", strings.TrimSuffix(fnCode, "*"), direct.Token.Str, strings.Join(args, ", "))
+		}
+
+		// Functions returned from C are not closures
+		if fnSig.Extern && n.Type.Kind == node.TypeFn && n.Type.Ref == 0 {
+			value := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = insertvalue { i8*, i8* } { i8* undef, i8* null }, i8* %s, 0\n", value, result)
+			result = value
 		}
 
-		fmt.Fprintln(c.out, ")")
 		return result
 
 	case *node.Unary:
@@ -335,12 +1070,24 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 		switch n.Token.Kind {
 		case token.Sub:
 			operand := c.compileExpr(n.Operand, false)
+			// Negated literals are range checked by the checker, and the
+			// minimum of a type is the negation of a literal which wraps
+			atom, ok := n.Operand.(*node.Atom)
+			if literal := ok && atom.Token.IsInteger(); c.debug && n.Type.IsSignedInt() && !n.Type.IsFloat() && !literal {
+				return c.overflowOp("sub", n.Type, "0", operand, n.Token.Pos, "Negation")
+			}
+
 			result := c.valueNew()
-			fmt.Fprintf(c.out, "    %s = sub %s 0, %s\n", result, llvmFormatType(n.Operand.GetType()), operand)
+			if n.Type.IsFloat() {
+				fmt.Fprintf(c.out, "    %s = fneg %s %s\n", result, llvmFormatType(n.Type), operand)
+			} else {
+				fmt.Fprintf(c.out, "    %s = sub %s 0, %s\n", result, llvmFormatType(n.Operand.GetType()), operand)
+			}
 			return result
 
 		case token.Mul:
 			operand := c.compileExpr(n.Operand, false)
+			c.nullCheck(operand, n.Operand.GetType(), n.Token.Pos)
 			if ref {
 				return operand
 			}
@@ -374,37 +1121,8 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 	case *node.Binary:
 		// @TokenKind
 		switch n.Token.Kind {
-		case token.Add:
-			return c.binaryArithOp(n, "add")
-
-		case token.Sub:
-			return c.binaryArithOp(n, "sub")
-
-		case token.Mul:
-			return c.binaryArithOp(n, "mul")
-
-		case token.Div:
-			if n.Type.IsSignedInt() {
-				return c.binaryArithOp(n, "sdiv")
-			} else {
-				return c.binaryArithOp(n, "udiv")
-			}
-
-		case token.Shl:
-			return c.binaryArithOp(n, "shl")
-
-		case token.Shr:
-			if n.Type.IsSignedInt() {
-				return c.binaryArithOp(n, "ashr")
-			} else {
-				return c.binaryArithOp(n, "lshr")
-			}
-
-		case token.BOr:
-			return c.binaryArithOp(n, "or")
-
-		case token.BAnd:
-			return c.binaryArithOp(n, "and")
+		case token.Add, token.Sub, token.Mul, token.Div, token.Mod, token.Shl, token.Shr, token.BOr, token.BAnd, token.BXor:
+			return c.binaryArithOp(n, arithOpcode(n.Token.Kind, n.Type))
 
 		case token.LOr:
 			return c.binaryLogicalOp(n)
@@ -420,47 +1138,186 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, rhs, llvmType, lhs)
 			return ""
 
+		case token.AddSet, token.SubSet, token.MulSet, token.DivSet, token.ModSet, token.ShlSet, token.ShrSet, token.BOrSet, token.BAndSet, token.BXorSet:
+			// The address is only evaluated once
+			lhs := c.compileExpr(n.Lhs, true)
+			lhsType := n.Lhs.GetType()
+			llvmType := llvmFormatType(lhsType)
+
+			current := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", current, llvmType, llvmType, lhs)
+
+			rhs := c.compileExpr(n.Rhs, false)
+			result := c.arithOp(arithOpcode(compoundOps[n.Token.Kind], lhsType), lhsType, current, rhs, n.Token.Pos)
+			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, result, llvmType, lhs)
+			return ""
+
 		case token.Gt:
-			if n.Lhs.GetType().IsSignedInt() {
+			if n.Lhs.GetType().IsFloat() {
+				return c.binaryOp(n, "fcmp ogt")
+			} else if n.Lhs.GetType().IsSignedInt() {
 				return c.binaryOp(n, "icmp sgt")
 			} else {
 				return c.binaryOp(n, "icmp ugt")
 			}
 
 		case token.Ge:
-			if n.Lhs.GetType().IsSignedInt() {
+			if n.Lhs.GetType().IsFloat() {
+				return c.binaryOp(n, "fcmp oge")
+			} else if n.Lhs.GetType().IsSignedInt() {
 				return c.binaryOp(n, "icmp sge")
 			} else {
 				return c.binaryOp(n, "icmp uge")
 			}
 
 		case token.Lt:
-			if n.Lhs.GetType().IsSignedInt() {
+			if n.Lhs.GetType().IsFloat() {
+				return c.binaryOp(n, "fcmp olt")
+			} else if n.Lhs.GetType().IsSignedInt() {
 				return c.binaryOp(n, "icmp slt")
 			} else {
 				return c.binaryOp(n, "icmp ult")
 			}
 
 		case token.Le:
-			if n.Lhs.GetType().IsSignedInt() {
+			if n.Lhs.GetType().IsFloat() {
+				return c.binaryOp(n, "fcmp ole")
+			} else if n.Lhs.GetType().IsSignedInt() {
 				return c.binaryOp(n, "icmp sle")
 			} else {
 				return c.binaryOp(n, "icmp ule")
 			}
 
+		// Comparisons with NaN are false, except for '!='
 		case token.Eq:
-			return c.binaryOp(n, "icmp eq")
+			if lhsType := n.Lhs.GetType(); lhsType.Kind == node.TypeFn && lhsType.Ref == 0 {
+				return c.fnCompareOp(n, "eq")
+			} else if lhsType.IsFloat() {
+				return c.binaryOp(n, "fcmp oeq")
+			} else {
+				return c.binaryOp(n, "icmp eq")
+			}
+
+		case token.Ne:
+			if lhsType := n.Lhs.GetType(); lhsType.Kind == node.TypeFn && lhsType.Ref == 0 {
+				return c.fnCompareOp(n, "ne")
+			} else if lhsType.IsFloat() {
+				return c.binaryOp(n, "fcmp une")
+			} else {
+				return c.binaryOp(n, "icmp ne")
+			}
+
+		case token.As:
+			return c.castOp(n.Lhs, n.Rhs)
+
+		case token.LBracket:
+			// Instances of generic functions
+			if lhsType := n.Lhs.GetType(); lhsType.Kind == node.TypeFn && lhsType.Ref == 0 {
+				return c.compileExpr(n.Lhs, ref)
+			}
+
+			return c.indexOp(n, ref)
+
+		case token.Dot:
+			switch lhsType := n.Lhs.GetType(); lhsType.Kind {
+			case node.TypeArray:
+				return fmt.Sprint(lhsType.Spec.(*node.Array).Count)
+
+			case node.TypeSlice:
+				pointer, length := c.sliceParts(c.sliceValue(n.Lhs, n.Token.Pos), lhsType)
+				if n.Rhs.Literal().Str == "ptr" {
+					return pointer
+				}
+				return length
+
+			case node.TypeEnum:
+				return c.compileConstant(n.Rhs.(*node.Atom).Defined.(*node.Let).Constant)
+
+			case node.TypeUnion:
+				return c.compileConstant(n)
+			}
+
+			s := n.Lhs.GetType().Spec.(*node.Struct)
+			index := s.Find(n.Rhs.Literal().Str)
+
+			if !n.Memory {
+				lhs := c.compileExpr(n.Lhs, false)
+				result := c.valueNew()
+				fmt.Fprintf(
+					c.out,
+					"    %s = extractvalue %s %s, %d\n",
+					result,
+					llvmFormatType(n.Lhs.GetType()),
+					lhs,
+					index,
+				)
+				return result
+			}
+
+			// Structures are automatically dereferenced
+			lhs := c.compileExpr(n.Lhs, n.Lhs.GetType().Ref == 0)
+			if n.Lhs.GetType().Ref != 0 {
+				c.nullCheck(lhs, n.Lhs.GetType(), n.Token.Pos)
+			}
+			llvmStruct := llvmFormatType(s.Type)
+
+			pointer := c.valueNew()
+			fmt.Fprintf(
+				c.out,
+				"    %s = getelementptr %s, %s* %s, i32 0, i32 %d\n",
+				pointer,
+				llvmStruct,
+				llvmStruct,
+				lhs,
+				index,
+			)
 
-		case token.Ne:
-			return c.binaryOp(n, "icmp ne")
+			if ref {
+				return pointer
+			}
 
-		case token.As:
-			return c.castOp(n.Lhs, n.Rhs)
+			llvmType := llvmFormatType(n.Type)
+			result := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmType, llvmType, pointer)
+			return result
 
 		default:
 			panic("unreachable")
 		}
 
+	case *node.Instance:
+		return c.compileExpr(n.Fn, ref)
+
+	case *node.Compound:
+		s := n.Type.Spec.(*node.Struct)
+		llvmStruct := llvmFormatType(n.Type)
+
+		result := "zeroinitializer"
+		for _, field := range n.Fields {
+			value := c.compileExpr(field.Assign, false)
+			next := c.valueNew()
+			fmt.Fprintf(
+				c.out,
+				"    %s = insertvalue %s %s, %s %s, %d\n",
+				next,
+				llvmStruct,
+				result,
+				llvmFormatType(field.Type),
+				value,
+				s.Find(field.Token.Str),
+			)
+			result = next
+		}
+
+		return result
+
+	case *node.Intrinsic:
+		return c.compileIntrinsic(n)
+
+	case *node.Fn:
+		// Function literals
+		return c.fnValue(n, ref)
+
 	case *node.Debug:
 		operand := c.compileExpr(n.Operand, false)
 
@@ -476,6 +1333,47 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 			return result
 
 		case token.DebugPrint:
+			if operandType := n.Operand.GetType(); operandType.Kind == node.TypeSlice {
+				pointer, length := c.sliceParts(operand, operandType)
+
+				precision := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = trunc i64 %s to i32\n", precision, length)
+
+				fmt.Fprintf(
+					c.out,
+					"    %s = call i32 (i8*, ...) @printf(i8* %s, i32 %s, i8* %s)\n",
+					c.valueNew(),
+					c.stringNew("%.*s\n"),
+					precision,
+					pointer,
+				)
+				return ""
+			}
+
+			if operandType := n.Operand.GetType(); operandType.Kind == node.TypeEnum {
+				c.enumPrint(operand, operandType.Spec.(*node.Enum))
+				return ""
+			}
+
+			if operandType := n.Operand.GetType(); operandType.IsFloat() {
+				value := c.variadicPromote(operand, operandType)
+				fmt.Fprintf(
+					c.out,
+					"    %s = call i32 (i8*, ...) @printf(i8* %s, %s)\n",
+					c.valueNew(),
+					c.stringNew("%g\n"),
+					value,
+				)
+				return ""
+			}
+
+			operandType := n.Operand.GetType()
+			if operandType.Ref == 0 && intSize(operandType.Kind) != -1 {
+				// The format expects 64 bits
+				operand = c.extendInt(operand, operandType)
+				operandType = node.Type{Kind: node.TypeI64}
+			}
+
 			fmtPointer := c.valueNew()
 			fmt.Fprintf(
 				c.out,
@@ -488,7 +1386,7 @@ func (c *Compiler) compileExpr(n node.Node, ref bool) string {
 				c.out,
 				"    call i32 (i8*, ...) @printf(i8* %s, %s %s)\n",
 				fmtPointer,
-				llvmFormatType(n.Operand.GetType()),
+				llvmFormatType(operandType),
 				operand,
 			)
 			return ""
@@ -540,11 +1438,34 @@ func (c *Compiler) compileStmt(n node.Node) {
 		fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", condition, body, finally)
 
 		fmt.Fprintf(c.out, "%s:\n", body)
+		c.loops = append(c.loops, loop{node: n, next: start, finally: finally})
 		c.compileStmt(n.Body)
+		c.loops = c.loops[:len(c.loops)-1]
 		fmt.Fprintf(c.out, "    br label %%%s\n", start)
 
 		fmt.Fprintf(c.out, "%s:\n", finally)
 
+	case *node.Match:
+		c.compileMatch(n)
+
+	case *node.For:
+		c.compileFor(n)
+
+	case *node.Branch:
+		for i := len(c.loops) - 1; i >= 0; i-- {
+			if l := c.loops[i]; l.node == n.Loop {
+				if n.Token.Kind == token.Break {
+					fmt.Fprintf(c.out, "    br label %%%s\n", l.finally)
+				} else {
+					fmt.Fprintf(c.out, "    br label %%%s\n", l.next)
+				}
+				break
+			}
+		}
+
+		// Anything after a branch is unreachable, see return
+		fmt.Fprintf(c.out, "%s:\n", c.labelNew())
+
 	case *node.Return:
 		if n.Operand != nil {
 			expr := c.compileExpr(n.Operand, false)
@@ -552,7 +1473,10 @@ func (c *Compiler) compileStmt(n node.Node) {
 		} else {
 			fmt.Fprintln(c.out, "    ret void")
 		}
-		c.valueNew() // Apparently this is needed??
+
+		// Anything after a return is unreachable, but it still needs to be in a
+		// block of its own
+		fmt.Fprintf(c.out, "%s:\n", c.labelNew())
 
 	case *node.Let:
 		llvmType := llvmFormatType(n.Type)
@@ -560,183 +1484,611 @@ func (c *Compiler) compileStmt(n node.Node) {
 			assign := c.compileExpr(n.Assign, false)
 			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, assign, llvmType, n.Token.Str)
 		} else {
-			if n.Type.Ref != 0 || n.Type.Kind == node.TypeFn || n.Type.Kind == node.TypeRawptr {
-				fmt.Fprintf(c.out, "    store %s null, %s* %s\n", llvmType, llvmType, n.Token.Str)
-			} else {
-				fmt.Fprintf(c.out, "    store %s 0, %s* %s\n", llvmType, llvmType, n.Token.Str)
-			}
+			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, llvmFormatZero(n.Type), llvmType, n.Token.Str)
 		}
 
+	case *node.Fn:
+		// Compiled after the function it is defined in
+
 	default:
 		c.compileExpr(n, false)
 	}
 }
 
+// Prints the name of the variant, or the underlying value if the enum was cast
+// from an integer which is not one
+func (c *Compiler) enumPrint(value string, e *node.Enum) {
+	base := e.BaseType()
+	llvmType := llvmFormatType(base)
+
+	finally := c.labelNew()
+	unknown := c.labelNew()
+
+	variants := make([]string, len(e.Variants))
+	cases := strings.Builder{}
+	for i, variant := range e.Variants {
+		variants[i] = c.labelNew()
+		fmt.Fprintf(&cases, "        %s %s, label %%%s\n", llvmType, c.compileConstant(variant.Constant), variants[i])
+	}
+
+	fmt.Fprintf(c.out, "    switch %s %s, label %%%s [\n%s    ]\n", llvmType, value, unknown, cases.String())
+
+	for i, variant := range e.Variants {
+		fmt.Fprintf(c.out, "%s:\n", variants[i])
+		fmt.Fprintf(
+			c.out,
+			"    %s = call i32 (i8*, ...) @printf(i8* %s)\n",
+			c.valueNew(),
+			c.stringNew(variant.Token.Str+"\n"),
+		)
+		fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+	}
+
+	fmt.Fprintf(c.out, "%s:\n", unknown)
+	extended := c.extendInt(value, base)
+	fmt.Fprintf(
+		c.out,
+		"    %s = call i32 (i8*, ...) @printf(i8* %s, i64 %s)\n",
+		c.valueNew(),
+		c.stringNew(e.Token.Str+"(%ld)\n"),
+		extended,
+	)
+	fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+
+	fmt.Fprintf(c.out, "%s:\n", finally)
+}
+
+// @TokenKind
+func (c *Compiler) compileIntrinsic(n *node.Intrinsic) string {
+	llvmType := llvmFormatType(n.Type)
+
+	operands := []string{}
+	for _, arg := range n.Args {
+		operands = append(operands, llvmType+" "+c.compileExpr(arg, false))
+	}
+
+	var name string
+	params := []string{llvmType}
+
+	switch n.Token.Kind {
+	case token.Popcount:
+		name = "ctpop"
+
+	case token.Clz, token.Ctz:
+		name = "ctlz"
+		if n.Token.Kind == token.Ctz {
+			name = "cttz"
+		}
+
+		// Counting the zeros of 0 is defined as the size of the type
+		operands = append(operands, "i1 false")
+		params = append(params, "i1")
+
+	case token.Bswap:
+		name = "bswap"
+
+	case token.Rotl, token.Rotr:
+		name = "fshl"
+		if n.Token.Kind == token.Rotr {
+			name = "fshr"
+		}
+
+		// A funnel shift of a value with itself is a rotation
+		operands = []string{operands[0], operands[0], operands[1]}
+		params = []string{llvmType, llvmType, llvmType}
+
+	default:
+		panic("unreachable")
+	}
+
+	name = fmt.Sprintf("@llvm.%s.%s", name, llvmType)
+	c.intrinsics[name] = fmt.Sprintf("declare %s %s(%s)", llvmType, name, strings.Join(params, ", "))
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = call %s %s(%s)\n", result, llvmType, name, strings.Join(operands, ", "))
+	return result
+}
+
+// Single values are matched with a switch. Ranges are compared in order when
+// none of them match
+func (c *Compiler) compileMatch(n *node.Match) {
+	if n.Subject.GetType().Kind == node.TypeUnion {
+		c.compileUnionMatch(n)
+		return
+	}
+
+	value := c.compileExpr(n.Subject, false)
+	llvmType := llvmFormatType(n.Subject.GetType())
+
+	finally := c.labelNew()
+	otherwise := finally
+	if n.Else != nil {
+		otherwise = c.labelNew()
+	}
+
+	type bounded struct {
+		bounds *node.Binary
+		arm    string
+	}
+	ranges := []bounded{}
+
+	arms := make([]string, len(n.Arms))
+	cases := strings.Builder{}
+	for i, arm := range n.Arms {
+		arms[i] = c.labelNew()
+		for _, pattern := range arm.Patterns {
+			if bounds, ok := pattern.(*node.Binary); ok {
+				ranges = append(ranges, bounded{bounds: bounds, arm: arms[i]})
+				continue
+			}
+
+			fmt.Fprintf(&cases, "        %s %s, label %%%s\n", llvmType, c.compileConstant(pattern), arms[i])
+		}
+	}
+
+	compare := otherwise
+	if len(ranges) != 0 {
+		compare = c.labelNew()
+	}
+
+	fmt.Fprintf(c.out, "    switch %s %s, label %%%s [\n%s    ]\n", llvmType, value, compare, cases.String())
+
+	signedness := "u"
+	if n.Subject.GetType().IsSignedInt() {
+		signedness = "s"
+	}
+
+	for i, r := range ranges {
+		fmt.Fprintf(c.out, "%s:\n", compare)
+
+		compare = otherwise
+		if i+1 < len(ranges) {
+			compare = c.labelNew()
+		}
+
+		last := "le"
+		if r.bounds.Token.Kind == token.DotDot {
+			last = "lt"
+		}
+
+		aboveFirst := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp %sge %s %s, %s\n", aboveFirst, signedness, llvmType, value, c.compileConstant(r.bounds.Lhs))
+
+		belowLast := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp %s%s %s %s, %s\n", belowLast, signedness, last, llvmType, value, c.compileConstant(r.bounds.Rhs))
+
+		within := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = and i1 %s, %s\n", within, aboveFirst, belowLast)
+		fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", within, r.arm, compare)
+	}
+
+	for i, arm := range n.Arms {
+		fmt.Fprintf(c.out, "%s:\n", arms[i])
+		c.compileStmt(arm.Body)
+		fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+	}
+
+	if n.Else != nil {
+		fmt.Fprintf(c.out, "%s:\n", otherwise)
+		c.compileStmt(n.Else)
+		fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+	}
+
+	fmt.Fprintf(c.out, "%s:\n", finally)
+}
+
+// Same shape as a while loop, with an extra block which advances the counter
+// so that it is not skipped by a continue
+func (c *Compiler) compileFor(n *node.For) {
+	start := c.labelNew()
+	body := c.labelNew()
+	next := c.labelNew()
+	finally := c.labelNew()
+
+	// Ranges count with the item itself, arrays and slices with the index
+	var counter *node.Let
+	var end string
+	var items string
+
+	predicate := "ult"
+	inclusive := false
+
+	if bounds, ok := n.Iterable.(*node.Binary); ok && (bounds.Token.Kind == token.DotDot || bounds.Token.Kind == token.DotDotEq) {
+		counter = n.Item
+
+		first := c.compileExpr(bounds.Lhs, false)
+		end = c.compileExpr(bounds.Rhs, false)
+
+		if bounds.Type.IsSignedInt() {
+			predicate = "slt"
+		}
+
+		if bounds.Token.Kind == token.DotDotEq {
+			predicate = predicate[:1] + "le"
+			inclusive = true
+		}
+
+		llvmType := llvmFormatType(counter.Type)
+		fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, first, llvmType, counter.Token.Str)
+	} else {
+		counter = n.Index
+
+		// Arrays and slices are automatically dereferenced
+		iterableType := n.Iterable.GetType()
+		if iterableType.Kind == node.TypeSlice {
+			items, end = c.sliceParts(c.sliceValue(n.Iterable, n.Iterable.Literal().Pos), iterableType)
+		} else {
+			array := iterableType.Spec.(*node.Array)
+			llvmArray := llvmFormatType(array.Type)
+
+			var base string
+			if n.Temp == nil {
+				base = c.compileExpr(n.Iterable, iterableType.Ref == 0)
+				if iterableType.Ref != 0 {
+					c.nullCheck(base, iterableType, n.Iterable.Literal().Pos)
+				}
+			} else {
+				value := c.compileExpr(n.Iterable, false)
+				base = n.Temp.Token.Str
+				fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmArray, value, llvmArray, base)
+			}
+
+			items = c.valueNew()
+			fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i64 0, i64 0\n", items, llvmArray, llvmArray, base)
+			end = fmt.Sprintf("%d", array.Count)
+		}
+
+		fmt.Fprintf(c.out, "    store i64 0, i64* %s\n", counter.Token.Str)
+	}
+
+	llvmType := llvmFormatType(counter.Type)
+	fmt.Fprintf(c.out, "    br label %%%s\n", start)
+	fmt.Fprintf(c.out, "%s:\n", start)
+
+	current := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", current, llvmType, llvmType, counter.Token.Str)
+
+	condition := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = icmp %s %s %s, %s\n", condition, predicate, llvmType, current, end)
+	fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", condition, body, finally)
+
+	fmt.Fprintf(c.out, "%s:\n", body)
+	if items != "" {
+		llvmItem := llvmFormatType(n.Item.Type)
+
+		item := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i64 %s\n", item, llvmItem, llvmItem, items, current)
+
+		value := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", value, llvmItem, llvmItem, item)
+		fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmItem, value, llvmItem, n.Item.Token.Str)
+	}
+
+	c.loops = append(c.loops, loop{node: n, next: next, finally: finally})
+	c.compileStmt(n.Body)
+	c.loops = c.loops[:len(c.loops)-1]
+	fmt.Fprintf(c.out, "    br label %%%s\n", next)
+
+	fmt.Fprintf(c.out, "%s:\n", next)
+	current = c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", current, llvmType, llvmType, counter.Token.Str)
+
+	// Inclusive ranges stop at the end, since the counter could overflow past it
+	if inclusive {
+		step := c.labelNew()
+
+		done := c.valueNew()
+		fmt.Fprintf(c.out, "    %s = icmp eq %s %s, %s\n", done, llvmType, current, end)
+		fmt.Fprintf(c.out, "    br i1 %s, label %%%s, label %%%s\n", done, finally, step)
+		fmt.Fprintf(c.out, "%s:\n", step)
+	}
+
+	advanced := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = add %s %s, 1\n", advanced, llvmType, current)
+	fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, advanced, llvmType, counter.Token.Str)
+	fmt.Fprintf(c.out, "    br label %%%s\n", start)
+
+	fmt.Fprintf(c.out, "%s:\n", finally)
+}
+
 // TODO: Test this
-func ensureMainFunction(context *checker.Context) {
+func ensureMainFunction(context *checker.Context, sink *diagnostic.Sink) bool {
 	if main, ok := context.Globals["main"]; ok {
 		mainTok := main.Literal()
 		mainType := main.GetType()
 
 		if mainType.Kind != node.TypeFn {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: The identifier 'main' must be a function\n",
-				mainTok.Pos,
-			)
-			os.Exit(1)
+			sink.Error(mainTok.Pos, "The identifier 'main' must be a function")
+			return false
 		}
 
 		if mainType.Ref != 0 {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: The entry function 'main' cannot be a pointer\n",
-				mainTok.Pos,
-			)
-			os.Exit(1)
+			sink.Error(mainTok.Pos, "The entry function 'main' cannot be a pointer")
+			return false
 		}
 
 		mainFn := mainType.Spec.(*node.Fn)
+		if mainFn.Generics != nil {
+			sink.Error(mainTok.Pos, "The entry function 'main' cannot be generic")
+			return false
+		}
+
 		if len(mainFn.Args) != 0 {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: The entry function 'main' cannot take any arguments\n",
-				mainTok.Pos,
-			)
-			os.Exit(1)
+			sink.Error(mainTok.Pos, "The entry function 'main' cannot take any arguments")
+			return false
 		}
 
 		if mainFn.Return != nil {
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: The entry function 'main' cannot return anything\n",
-				mainTok.Pos,
-			)
-			os.Exit(1)
+			sink.Error(mainTok.Pos, "The entry function 'main' cannot return anything")
+			return false
 		}
 
 		// Yozi expects  fn main()
 		// Clang expects fn main() i32
 		mainFn.Token.Str = ".main"
-		return
+		return true
 	}
 
-	fmt.Fprintln(os.Stderr, "ERROR: The entry function 'main' has not been defined")
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "+ fn main() {")
-	fmt.Fprintln(os.Stderr, "+     // This function MUST be defined")
-	fmt.Fprintln(os.Stderr, "+ }")
-	os.Exit(1)
+	sink.Error(
+		token.Pos{},
+		"The entry function 'main' has not been defined\n\n"+
+			"+ fn main() {\n"+
+			"+     // This function MUST be defined\n"+
+			"+ }",
+	)
+	return false
 }
 
 func normalizeGlobalNames(context *checker.Context) {
-	for _, g := range context.Globals {
+	for i, g := range context.Ordered {
 		switch g := g.(type) {
 		case *node.Fn:
-			g.Token.Str = "@" + g.Token.Str
+			if g.Token.Kind == token.Fn {
+				// Function literals in the initializers of globals
+				g.Token.Str = fmt.Sprintf("@.fn.%d", i)
+			} else if g.Generic != nil {
+				g.Token.Str = llvmFormatInstanceName(g)
+			} else if g.Extern {
+				g.Token.Str = "@" + g.Token.Str
+			} else {
+				g.Token.Str = "@" + runtimeRename(g.Token.Str)
+			}
 
 		case *node.Let:
-			g.Token.Str = "@" + g.Token.Str
+			g.Token.Str = "@" + runtimeRename(g.Token.Str)
 		}
 	}
 }
 
-func Program(context *checker.Context, exePath string) {
-	ensureMainFunction(context)
-	normalizeGlobalNames(context)
+// A function of the C library which the compiler calls itself
+type runtimeFn struct {
+	name string
+	yozi string
+	llvm string
+}
 
-	asmPath := exePath + ".ll"
+var runtimeFns = []runtimeFn{
+	{"printf", "extern fn printf(format &u8, ...) i32", "declare i32 @printf(i8*, ...)"},
+	{"malloc", "extern fn malloc(size i64) rawptr", "declare i8* @malloc(i64)"},
+	{"dprintf", "extern fn dprintf(fd i32, format &u8, ...) i32", "declare i32 @dprintf(i32, i8*, ...)"},
+	{"exit", "extern fn exit(code i32)", "declare void @exit(i32)"},
+}
 
-	var err error
-	var compiler Compiler
+// Definitions which are named like the functions used by the compiler are
+// renamed, much like main. Identifiers cannot start with a dot
+func runtimeRename(name string) string {
+	for _, r := range runtimeFns {
+		if r.name == name {
+			return "." + name
+		}
+	}
 
-	compiler.context = context
-	compiler.out, err = os.Create(asmPath)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "ERROR:", err)
-		os.Exit(1)
+	return name
+}
+
+// Functions used by the compiler which are declared by the user must agree
+// with the declarations the compiler expects, as there can only be one
+func ensureRuntimeFunctions(context *checker.Context, sink *diagnostic.Sink) bool {
+	ok := true
+	for _, r := range runtimeFns {
+		fn, isFn := context.Globals[r.name].(*node.Fn)
+		if !isFn || !fn.Extern || llvmFormatExternDecl(fn) == r.llvm {
+			continue
+		}
+
+		sink.Error(fn.Token.Pos, "Declaration of '%s' conflicts with '%s' used by the compiler", r.name, r.yozi)
+		ok = false
 	}
 
-	// Compile the globals
-	for _, g := range compiler.context.Globals {
-		compiler.valueId = 0
-		compiler.labelId = 0
+	return ok
+}
+
+// Nested functions are compiled after the function they are defined in
+func (c *Compiler) compileFn(g *node.Fn, debug bool) {
+	c.valueId = 0
+	c.labelId = 0
+	c.debug = debug && !g.Unchecked
+
+	returnType := g.ReturnType()
+	fmt.Fprintf(c.out, "define %s %s(", llvmFormatType(returnType), g.Token.Str)
+
+	// Closures take their environment as the first argument
+	if len(g.Captures) != 0 {
+		fmt.Fprintf(c.out, "i8* %%env")
+		if len(g.Args) != 0 {
+			fmt.Fprint(c.out, ", ")
+		}
+	}
+
+	for i, arg := range g.Args {
+		if i != 0 {
+			fmt.Fprint(c.out, ", ")
+		}
+
+		arg.Token.Str = fmt.Sprintf("%%a%d", i)
+		fmt.Fprintf(c.out, "%s %s", llvmFormatType(arg.Type), arg.Token.Str)
+	}
+
+	fmt.Fprintln(c.out, ") {")
+	fmt.Fprintln(c.out, "$0:")
+
+	for i, arg := range g.Args {
+		if arg.Kind == node.LetLocalArg {
+			arg.Token.Str = fmt.Sprintf("%%v%d", i)
+			fmt.Fprintf(
+				c.out,
+				"    %s = alloca %s\n",
+				arg.Token.Str,
+				llvmFormatType(arg.Type),
+			)
+
+			llvmType := llvmFormatType(arg.Type)
+			fmt.Fprintf(
+				c.out,
+				"    store %s %%a%d, %s* %s\n",
+				llvmType,
+				i,
+				llvmType,
+				arg.Token.Str,
+			)
+		}
+	}
+
+	nested := []*node.Fn{}
+	for i, l := range g.Locals {
+		switch l := l.(type) {
+		case *node.Let:
+			l.Token.Str = fmt.Sprintf("%%v%d", len(g.Args)+i)
+			fmt.Fprintf(
+				c.out,
+				"    %s = alloca %s\n",
+				l.Token.Str,
+				llvmFormatType(l.Type),
+			)
 
-		globalType := g.GetType()
-		switch g := g.(type) {
 		case *node.Fn:
-			returnType := g.ReturnType()
-			fmt.Fprintf(compiler.out, "define %s %s(", llvmFormatType(returnType), g.Token.Str)
+			// The value of a nested function is kept in a local variable, so
+			// that other nested functions can capture it like any other
+			slot := fmt.Sprintf("%%v%d", len(g.Args)+i)
+			fmt.Fprintf(c.out, "    %s = alloca %s\n", slot, llvmFormatType(l.Type))
+
+			l.Token.Str = llvmFormatNestedName(g.Token.Str, i)
+			c.closures[l] = slot
+			nested = append(nested, l)
+		}
+	}
+
+	c.environmentLoad(g)
+	for _, fn := range nested {
+		c.closureStore(fn)
+	}
+
+	c.compileStmt(g.Body)
 
-			for i, arg := range g.Args {
+	if returnType.Equal(node.Type{Kind: node.TypeUnit}) {
+		fmt.Fprintln(c.out, "    ret void")
+	} else {
+		// The checker ensures that every path returns a value
+		fmt.Fprintln(c.out, "    unreachable")
+	}
+
+	fmt.Fprintln(c.out, "}")
+
+	for _, fn := range nested {
+		c.compileFn(fn, debug)
+	}
+}
+
+// Returns the LLVM IR of the program
+func Program(context *checker.Context, sink *diagnostic.Sink, debug bool) string {
+	if !ensureMainFunction(context, sink) {
+		return ""
+	}
+	normalizeGlobalNames(context)
+	if !ensureRuntimeFunctions(context, sink) {
+		return ""
+	}
+
+	var compiler Compiler
+
+	compiler.context = context
+	compiler.stringIds = make(map[string]int)
+	compiler.intrinsics = make(map[string]string)
+	compiler.closures = make(map[*node.Fn]string)
+	compiler.out = &strings.Builder{}
+
+	// Compile the types, they must be defined before being used
+	for _, g := range compiler.context.Ordered {
+		if g, ok := g.(*node.Struct); ok {
+			fmt.Fprintf(compiler.out, "%s = type {", llvmFormatType(g.Type))
+			for i, field := range g.Fields {
 				if i != 0 {
-					fmt.Fprint(compiler.out, ", ")
+					fmt.Fprint(compiler.out, ",")
 				}
 
-				arg.Token.Str = fmt.Sprintf("%%a%d", i)
-				fmt.Fprintf(compiler.out, "%s %s", llvmFormatType(arg.Type), arg.Token.Str)
-			}
-
-			fmt.Fprintln(compiler.out, ") {")
-			fmt.Fprintln(compiler.out, "$0:")
-
-			for i, arg := range g.Args {
-				if arg.Kind == node.LetLocalArg {
-					arg.Token.Str = fmt.Sprintf("%%v%d", i)
-					fmt.Fprintf(
-						compiler.out,
-						"    %s = alloca %s\n",
-						arg.Token.Str,
-						llvmFormatType(arg.Type),
-					)
-
-					llvmType := llvmFormatType(arg.Type)
-					fmt.Fprintf(
-						compiler.out,
-						"    store %s %%a%d, %s* %s\n",
-						llvmType,
-						i,
-						llvmType,
-						arg.Token.Str,
-					)
-				}
+				fmt.Fprintf(compiler.out, " %s", llvmFormatType(field.Type))
 			}
+			fmt.Fprintln(compiler.out, " }")
+		}
 
-			for i, l := range g.Locals {
-				// TODO: Assuming functions can't be nested
-				switch l := l.(type) {
-				case *node.Let:
-					l.Token.Str = fmt.Sprintf("%%v%d", len(g.Args)+i)
-					fmt.Fprintf(
-						compiler.out,
-						"    %s = alloca %s\n",
-						l.Token.Str,
-						llvmFormatType(l.Type),
-					)
+		if g, ok := g.(*node.Union); ok {
+			fmt.Fprintf(compiler.out, "%s = type %s\n", llvmFormatType(g.Type), llvmFormatUnion(g))
+			for _, variant := range g.Variants {
+				fmt.Fprintf(compiler.out, "%s = type {", llvmFormatVariant(g, variant))
+				for i, field := range variant.Fields {
+					if i != 0 {
+						fmt.Fprint(compiler.out, ",")
+					}
+
+					fmt.Fprintf(compiler.out, " %s", llvmFormatType(field.Type))
 				}
+				fmt.Fprintln(compiler.out, " }")
 			}
+		}
+	}
+
+	// Compile the globals
+	for _, g := range compiler.context.Ordered {
+		compiler.valueId = 0
+		compiler.labelId = 0
 
-			compiler.compileStmt(g.Body)
+		globalType := g.GetType()
+		switch g := g.(type) {
+		case *node.Fn:
+			// Only the instances are compiled
+			if g.Generics != nil {
+				break
+			}
 
-			if returnType.Equal(node.Type{Kind: node.TypeUnit}) {
-				fmt.Fprintln(compiler.out, "    ret void")
+			if g.Extern {
+				fmt.Fprintln(compiler.out, llvmFormatExternDecl(g))
+				break
 			}
 
-			fmt.Fprintln(compiler.out, "}")
+			compiler.compileFn(g, debug)
 
 		case *node.Let:
+			value := llvmFormatZero(globalType)
+			if g.Constant != nil {
+				value = compiler.compileConstant(g.Constant)
+			}
+
 			fmt.Fprintf(
 				compiler.out,
-				"%s = global %s ",
+				"%s = global %s %s\n",
 				g.Literal().Str,
 				llvmFormatType(globalType),
+				value,
 			)
 
-			if globalType.Ref != 0 || globalType.Kind == node.TypeFn || globalType.Kind == node.TypeRawptr {
-				fmt.Fprintf(compiler.out, "null\n")
-			} else {
-				fmt.Fprintf(compiler.out, "0\n")
-			}
+		case *node.Struct:
+			// Already compiled
+
+		case *node.Enum:
+			// Represented by the underlying integer
+
+		case *node.Union:
+			// Already compiled
 
 		default:
 			panic("unreachable")
@@ -745,34 +2097,60 @@ func Program(context *checker.Context, exePath string) {
 
 	// @Temporary
 	fmt.Fprintln(compiler.out, `@.print = private unnamed_addr constant [5 x i8] c"%ld\0A\00"`)
-	fmt.Fprintln(compiler.out, "declare i32 @printf(i8*, ...)")
-	fmt.Fprintln(compiler.out, "declare i8* @malloc(i64)")
 
+	// Unless already declared by the user
+	for _, r := range runtimeFns {
+		if fn, ok := context.Globals[r.name].(*node.Fn); ok && fn.Extern {
+			continue
+		}
+
+		fmt.Fprintln(compiler.out, r.llvm)
+	}
+
+	compiler.valueId = 0
+	compiler.labelId = 0
+
+	compiler.debug = debug
 	fmt.Fprintln(compiler.out, "define i32 @main() {")
 	fmt.Fprintln(compiler.out, "$0:")
 
+	for i, temp := range context.Temps {
+		temp.Token.Str = fmt.Sprintf("%%v%d", i)
+		fmt.Fprintf(compiler.out, "    %s = alloca %s\n", temp.Token.Str, llvmFormatType(temp.Type))
+	}
+
 	// Assign the global variables
-	for _, g := range compiler.context.Globals {
-		if _, ok := g.(*node.Let); ok {
-			compiler.compileStmt(g)
-		}
+	for _, g := range compiler.context.Initializers {
+		compiler.compileStmt(g)
 	}
 
 	fmt.Fprintln(compiler.out, "    call void @.main()")
 	fmt.Fprintln(compiler.out, "    ret i32 0")
 	fmt.Fprintln(compiler.out, "}")
 
-	compiler.out.Close()
+	for i, s := range compiler.strings {
+		fmt.Fprintf(
+			compiler.out,
+			"@.str.%d = private unnamed_addr constant [%d x i8] %s\n",
+			i,
+			len(s)+1,
+			llvmFormatString(s),
+		)
+	}
+
+	for i, s := range compiler.literals {
+		fmt.Fprintf(
+			compiler.out,
+			"@.literal.%d = private global [%d x i8] %s\n",
+			i,
+			len(s)+1,
+			llvmFormatString(s),
+		)
+	}
 
-	cmd := exec.Command("clang", "-Wno-override-module", "-o", exePath, asmPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "ERROR:", err)
-		os.Exit(1)
+	for _, name := range slices.Sorted(maps.Keys(compiler.intrinsics)) {
+		fmt.Fprintln(compiler.out, compiler.intrinsics[name])
 	}
 
-	// @Temporary: Turn this on later
-	// os.Remove(asmPath)
+	return compiler.out.String()
 }
@@ -0,0 +1,43 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"yozi/node"
+	"yozi/token"
+)
+
+// Returns the function which is referenced by name, if any. Explicit instances
+// of generic functions are referenced through the name of the generic one
+func directFn(n node.Node) *node.Fn {
+	switch n := n.(type) {
+	case *node.Atom:
+		fn, _ := n.Defined.(*node.Fn)
+		return fn
+
+	case *node.Instance:
+		return directFn(n.Fn)
+
+	case *node.Binary:
+		if n.Token.Kind == token.LBracket {
+			return directFn(n.Lhs)
+		}
+	}
+
+	return nil
+}
+
+// Instances of generic functions are named after the types they are
+// instantiated with, like @"max[i64]", which needs to be quoted
+func llvmFormatInstanceName(instance *node.Fn) string {
+	return fmt.Sprintf("@\"%s\"", instance.Token.Str)
+}
+
+// Nested functions are named after the function they are defined in
+func llvmFormatNestedName(parent string, index int) string {
+	if quoted, ok := strings.CutSuffix(parent, "\""); ok {
+		return fmt.Sprintf("%s.%d\"", quoted, index)
+	}
+
+	return fmt.Sprintf("%s.%d", parent, index)
+}
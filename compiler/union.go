@@ -0,0 +1,246 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"yozi/node"
+)
+
+func alignTo(size int, align int) int {
+	return (size + align - 1) / align * align
+}
+
+// The size and alignment of a type in bytes, as laid out by LLVM on 64-bit
+// targets. Only needs to be exact enough for the payloads of unions to fit
+//
+// @TypeKind
+func llvmSizeOf(t node.Type) (int, int) {
+	if t.Ref != 0 {
+		return 8, 8
+	}
+
+	switch t.Kind {
+	case node.TypeUnit:
+		return 0, 1
+
+	case node.TypeBool, node.TypeI8, node.TypeU8:
+		return 1, 1
+
+	case node.TypeI16, node.TypeU16:
+		return 2, 2
+
+	case node.TypeI32, node.TypeU32, node.TypeF32:
+		return 4, 4
+
+	case node.TypeI64, node.TypeU64, node.TypeF64, node.TypeRawptr:
+		return 8, 8
+
+	case node.TypeFn, node.TypeSlice:
+		return 16, 8
+
+	case node.TypeStruct:
+		return llvmSizeOfFields(t.Spec.(*node.Struct).Fields)
+
+	case node.TypeEnum:
+		return llvmSizeOf(t.Underlying())
+
+	case node.TypeUnion:
+		u := t.Spec.(*node.Union)
+		tagSize, _ := llvmSizeOf(u.TagType())
+		count, align := unionPayload(u)
+
+		size := alignTo(tagSize, align) + count*align
+		align = max(align, tagSize)
+		return alignTo(size, align), align
+
+	case node.TypeArray:
+		array := t.Spec.(*node.Array)
+		size, align := llvmSizeOf(array.Item.GetType())
+		return size * int(array.Count), align
+
+	default:
+		panic("unreachable")
+	}
+}
+
+func llvmSizeOfFields(fields []*node.Let) (int, int) {
+	size := 0
+	align := 1
+	for _, field := range fields {
+		fieldSize, fieldAlign := llvmSizeOf(field.Type)
+		size = alignTo(size, fieldAlign) + fieldSize
+		align = max(align, fieldAlign)
+	}
+
+	return alignTo(size, align), align
+}
+
+// The payloads of unions are stored in an array of integers as large as the
+// largest alignment of the variants. Returns the length and the size of that
+// integer
+func unionPayload(u *node.Union) (int, int) {
+	size := 0
+	align := 1
+	for _, variant := range u.Variants {
+		variantSize, variantAlign := llvmSizeOfFields(variant.Fields)
+		size = max(size, variantSize)
+		align = max(align, variantAlign)
+	}
+
+	return alignTo(size, align) / align, align
+}
+
+// The tag followed by the payload
+func llvmFormatUnion(u *node.Union) string {
+	count, align := unionPayload(u)
+	return fmt.Sprintf("{ %s, [%d x i%d] }", llvmFormatType(u.TagType()), count, align*8)
+}
+
+func llvmFormatVariant(u *node.Union, variant *node.Struct) string {
+	return fmt.Sprintf("%%union.%s.%s", u.Token.Str, variant.Token.Str)
+}
+
+// The value of a variant without a payload, as a constant
+func llvmFormatVariantValue(u *node.Union, index int) string {
+	count, align := unionPayload(u)
+	return fmt.Sprintf(
+		"{ %s %d, [%d x i%d] zeroinitializer }",
+		llvmFormatType(u.TagType()),
+		index,
+		count,
+		align*8,
+	)
+}
+
+// Returns the variant which the access refers to, along with its index
+func unionVariant(access node.Node) (*node.Union, int) {
+	n := access.(*node.Binary)
+	u := n.Lhs.(*node.Atom).Defined.(*node.Union)
+	return u, u.Find(n.Rhs.Literal().Str)
+}
+
+// Returns a pointer to the payload of the union, as the variant
+func (c *Compiler) payloadOf(union string, u *node.Union, variant *node.Struct) string {
+	llvmType := llvmFormatType(u.Type)
+	count, align := unionPayload(u)
+
+	payload := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 1\n", payload, llvmType, llvmType, union)
+
+	result := c.valueNew()
+	fmt.Fprintf(
+		c.out,
+		"    %s = bitcast [%d x i%d]* %s to %s*\n",
+		result,
+		count,
+		align*8,
+		payload,
+		llvmFormatVariant(u, variant),
+	)
+	return result
+}
+
+// Shape.Circle(69)
+func (c *Compiler) compileConstruction(n *node.Call) string {
+	u, index := unionVariant(n.Fn)
+	variant := u.Variants[index]
+
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = c.compileExpr(arg, false)
+	}
+
+	llvmType := llvmFormatType(u.Type)
+	tagType := llvmFormatType(u.TagType())
+
+	tag := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 0\n", tag, llvmType, llvmType, n.Temp.Token.Str)
+	fmt.Fprintf(c.out, "    store %s %d, %s* %s\n", tagType, index, tagType, tag)
+
+	if len(args) != 0 {
+		payload := c.payloadOf(n.Temp.Token.Str, u, variant)
+		variantType := llvmFormatVariant(u, variant)
+		for i, field := range variant.Fields {
+			fieldType := llvmFormatType(field.Type)
+
+			pointer := c.valueNew()
+			fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 %d\n", pointer, variantType, variantType, payload, i)
+			fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", fieldType, args[i], fieldType, pointer)
+		}
+	}
+
+	result := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", result, llvmType, llvmType, n.Temp.Token.Str)
+	return result
+}
+
+func (c *Compiler) compileUnionMatch(n *node.Match) {
+	u := n.Subject.GetType().Spec.(*node.Union)
+	llvmType := llvmFormatType(u.Type)
+	tagType := llvmFormatType(u.TagType())
+
+	subject := ""
+	if n.Temp != nil {
+		value := c.compileExpr(n.Subject, false)
+		fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", llvmType, value, llvmType, n.Temp.Token.Str)
+		subject = n.Temp.Token.Str
+	} else {
+		subject = c.compileExpr(n.Subject, true)
+	}
+
+	tagPointer := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 0\n", tagPointer, llvmType, llvmType, subject)
+
+	tag := c.valueNew()
+	fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", tag, tagType, tagType, tagPointer)
+
+	finally := c.labelNew()
+	otherwise := finally
+	if n.Else != nil {
+		otherwise = c.labelNew()
+	}
+
+	arms := make([]string, len(n.Arms))
+	cases := strings.Builder{}
+	for i, arm := range n.Arms {
+		arms[i] = c.labelNew()
+		for _, pattern := range arm.Patterns {
+			fmt.Fprintf(&cases, "        %s %s, label %%%s\n", tagType, c.compileConstant(pattern), arms[i])
+		}
+	}
+
+	fmt.Fprintf(c.out, "    switch %s %s, label %%%s [\n%s    ]\n", tagType, tag, otherwise, cases.String())
+
+	for i, arm := range n.Arms {
+		fmt.Fprintf(c.out, "%s:\n", arms[i])
+
+		// The payload is copied into the bindings before the body can modify it
+		if len(arm.Bindings) != 0 {
+			variant := u.Variants[arm.Patterns[0].(*node.Atom).Token.Int]
+			variantType := llvmFormatVariant(u, variant)
+			payload := c.payloadOf(subject, u, variant)
+
+			for j, binding := range arm.Bindings {
+				fieldType := llvmFormatType(binding.Type)
+
+				pointer := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = getelementptr %s, %s* %s, i32 0, i32 %d\n", pointer, variantType, variantType, payload, j)
+
+				value := c.valueNew()
+				fmt.Fprintf(c.out, "    %s = load %s, %s* %s\n", value, fieldType, fieldType, pointer)
+				fmt.Fprintf(c.out, "    store %s %s, %s* %s\n", fieldType, value, fieldType, binding.Token.Str)
+			}
+		}
+
+		c.compileStmt(arm.Body)
+		fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+	}
+
+	if n.Else != nil {
+		fmt.Fprintf(c.out, "%s:\n", otherwise)
+		c.compileStmt(n.Else)
+		fmt.Fprintf(c.out, "    br label %%%s\n", finally)
+	}
+
+	fmt.Fprintf(c.out, "%s:\n", finally)
+}
@@ -0,0 +1,100 @@
+package diagnostic
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"yozi/token"
+)
+
+type Severity = byte
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+var severityNames = [...]string{
+	Error:   "ERROR",
+	Warning: "WARNING",
+}
+
+type Note struct {
+	Pos     token.Pos
+	Message string
+}
+
+type Diagnostic struct {
+	Severity Severity
+	Pos      token.Pos
+	Message  string
+	Notes    []Note
+}
+
+func (d *Diagnostic) Note(pos token.Pos, format string, args ...any) *Diagnostic {
+	d.Notes = append(d.Notes, Note{Pos: pos, Message: fmt.Sprintf(format, args...)})
+	return d
+}
+
+// Diagnostics which do not belong to any file are reported without a position
+func (d *Diagnostic) String() string {
+	sb := strings.Builder{}
+	if d.Pos.Path != "" {
+		fmt.Fprintf(&sb, "%s: ", d.Pos)
+	}
+	fmt.Fprintf(&sb, "%s: %s\n", severityNames[d.Severity], d.Message)
+
+	for _, note := range d.Notes {
+		fmt.Fprintf(&sb, "%s: NOTE: %s\n", note.Pos, note.Message)
+	}
+
+	return sb.String()
+}
+
+type Sink struct {
+	Diagnostics []*Diagnostic
+	errors      int
+}
+
+func (s *Sink) report(severity Severity, pos token.Pos, format string, args ...any) *Diagnostic {
+	d := &Diagnostic{
+		Severity: severity,
+		Pos:      pos,
+		Message:  fmt.Sprintf(format, args...),
+	}
+
+	if severity == Error {
+		s.errors++
+	}
+
+	s.Diagnostics = append(s.Diagnostics, d)
+	return d
+}
+
+func (s *Sink) Error(pos token.Pos, format string, args ...any) *Diagnostic {
+	return s.report(Error, pos, format, args...)
+}
+
+func (s *Sink) Warning(pos token.Pos, format string, args ...any) *Diagnostic {
+	return s.report(Warning, pos, format, args...)
+}
+
+func (s *Sink) HasErrors() bool {
+	return s.errors != 0
+}
+
+// Diagnostics are reported in the order they are found, which is not
+// necessarily the order they appear in the source
+func (s *Sink) Sort() {
+	slices.SortStableFunc(s.Diagnostics, func(a, b *Diagnostic) int {
+		if a.Pos.Path != b.Pos.Path {
+			return strings.Compare(a.Pos.Path, b.Pos.Path)
+		}
+
+		if a.Pos.Row != b.Pos.Row {
+			return a.Pos.Row - b.Pos.Row
+		}
+
+		return a.Pos.Col - b.Pos.Col
+	})
+}
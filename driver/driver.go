@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"yozi/checker"
+	"yozi/compiler"
+	"yozi/diagnostic"
+	"yozi/lexer"
+	"yozi/parser"
+)
+
+// Returned when compilation stops because of errors in the diagnostics
+var ErrInvalid = errors.New("invalid program")
+
+type Options struct {
+	// The path of the source file, also used as the position in diagnostics
+	Path string
+
+	// The source code. If nil, it is read from Path
+	Source []byte
+
+	// The path of the executable. If empty, only the LLVM IR is generated
+	OutputPath string
+
+	// Flags passed to the linker (clang)
+	LinkFlags []string
+
+	// Abort the program on integer overflow and division by zero, instead of
+	// wrapping around
+	Debug bool
+}
+
+type Result struct {
+	IR      string
+	ExePath string
+}
+
+// Compiles a single source file. The diagnostics are sorted by position and
+// may contain warnings even if compilation succeeds
+func Compile(options Options) (Result, []*diagnostic.Diagnostic, error) {
+	result := Result{}
+	sink := diagnostic.Sink{}
+
+	diagnostics := func() []*diagnostic.Diagnostic {
+		sink.Sort()
+		return sink.Diagnostics
+	}
+
+	path := options.Path
+	if path == "" {
+		path = "<input>"
+	}
+
+	source := options.Source
+	if source == nil {
+		var err error
+		source, err = os.ReadFile(options.Path)
+		if err != nil {
+			return result, nil, err
+		}
+	}
+
+	parser := parser.New(&sink)
+	parser.File(lexer.New(path, source, &sink))
+
+	// Syntax errors leave holes in the tree, checking it would only produce
+	// errors about things that are missing
+	if sink.HasErrors() {
+		return result, diagnostics(), ErrInvalid
+	}
+
+	context := checker.NewContext(&sink)
+	for _, node := range parser.Nodes {
+		context.Check(node)
+	}
+
+	if sink.HasErrors() {
+		return result, diagnostics(), ErrInvalid
+	}
+
+	result.IR = compiler.Program(&context, &sink, options.Debug)
+	if sink.HasErrors() {
+		return result, diagnostics(), ErrInvalid
+	}
+
+	if options.OutputPath == "" {
+		return result, diagnostics(), nil
+	}
+
+	irPath := options.OutputPath + ".ll"
+	if err := os.WriteFile(irPath, []byte(result.IR), 0644); err != nil {
+		return result, diagnostics(), err
+	}
+
+	args := []string{"-Wno-override-module", "-o", options.OutputPath, irPath}
+	cmd := exec.Command("clang", append(args, options.LinkFlags...)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) != 0 {
+			err = fmt.Errorf("clang: %w\n%s", err, output)
+		}
+
+		return result, diagnostics(), err
+	}
+
+	// @Temporary: Turn this on later
+	// os.Remove(irPath)
+
+	result.ExePath = options.OutputPath
+	return result, diagnostics(), nil
+}
@@ -1,9 +1,8 @@
 package lexer
 
 import (
-	"fmt"
-	"os"
-	"slices"
+	"strconv"
+	"yozi/diagnostic"
 	"yozi/token"
 )
 
@@ -27,6 +26,22 @@ func isPrint(ch byte) bool {
 	return ch >= 32 && ch <= 126
 }
 
+func hexValue(ch byte) (byte, bool) {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return ch - '0', true
+
+	case 'a' <= ch && ch <= 'f':
+		return ch - 'a' + 10, true
+
+	case 'A' <= ch && ch <= 'F':
+		return ch - 'A' + 10, true
+
+	default:
+		return 0, false
+	}
+}
+
 type Lexer struct {
 	pos   token.Pos
 	bytes []byte
@@ -38,17 +53,16 @@ type Lexer struct {
 	peeked bool
 	buffer token.Token
 
-	onNewline bool
-}
+	// The braces read so far which are not closed yet
+	depth int
 
-func New(path string) (Lexer, error) {
-	l := Lexer{}
+	onNewline bool
 
-	bytes, err := os.ReadFile(path)
-	if err != nil {
-		return l, err
-	}
+	sink *diagnostic.Sink
+}
 
+func New(path string, bytes []byte, sink *diagnostic.Sink) Lexer {
+	l := Lexer{sink: sink}
 	l.pos.Path = path
 	l.bytes = bytes
 	l.size = len(bytes)
@@ -57,7 +71,7 @@ func New(path string) (Lexer, error) {
 		l.ch = l.bytes[0]
 	}
 
-	return l, nil
+	return l
 }
 
 func (l *Lexer) nextChar() {
@@ -100,6 +114,115 @@ func (l *Lexer) matchChar(ch byte) bool {
 	return false
 }
 
+// Returns the compound assignment form of an operator if followed by '='
+func (l *Lexer) matchSet(op token.Kind, set token.Kind) token.Kind {
+	if l.matchChar('=') {
+		return set
+	}
+
+	return op
+}
+
+// Reads a character of a string or character literal, decoding the escape
+// sequences
+func (l *Lexer) readLiteralChar() byte {
+	if l.ch != '\\' {
+		return l.readChar()
+	}
+
+	pos := l.pos
+	l.nextChar()
+
+	switch ch := l.readChar(); ch {
+	case 'n':
+		return '\n'
+
+	case 't':
+		return '\t'
+
+	case 'r':
+		return '\r'
+
+	case '0':
+		return 0
+
+	case '\\', '"', '\'':
+		return ch
+
+	case 'x':
+		hi, hiOk := hexValue(l.ch)
+		if hiOk {
+			l.nextChar()
+		}
+
+		lo, loOk := hexValue(l.ch)
+		if loOk {
+			l.nextChar()
+		}
+
+		if !hiOk || !loOk {
+			l.sink.Error(pos, "Expected 2 hexadecimal digits in escape sequence")
+		}
+
+		return hi<<4 | lo
+
+	default:
+		message := "Invalid escape sequence '\\%c'"
+		if !isPrint(ch) {
+			message = "Invalid escape sequence with character %d"
+		}
+
+		l.sink.Error(pos, message, ch)
+		return ch
+	}
+}
+
+// Reads the digits of a numeric literal along with the '_' separators. Decimal
+// digits beyond the base are read as well so that they get reported
+func (l *Lexer) readDigits(base int) {
+	for l.head < l.size {
+		_, isHex := hexValue(l.ch)
+		if !isDigit(l.ch) && l.ch != '_' && !(base == 16 && isHex) {
+			break
+		}
+		l.nextChar()
+	}
+}
+
+var baseNames = map[int]string{
+	2:  "binary",
+	8:  "octal",
+	16: "hexadecimal",
+}
+
+// Returns false after reporting the first invalid digit or separator
+func (l *Lexer) checkDigits(pos token.Pos, literal string, digits string, base int) bool {
+	if digits == "" {
+		l.sink.Error(pos, "Missing digits in %s literal '%s'", baseNames[base], literal)
+		return false
+	}
+
+	for i := 0; i < len(digits); i++ {
+		if digits[i] == '_' {
+			// Separators must be followed by a digit
+			next := byte(0)
+			if i+1 < len(digits) {
+				next = digits[i+1]
+			}
+
+			if value, ok := hexValue(next); !ok || int(value) >= base {
+				l.sink.Error(pos, "Invalid digit separator in literal '%s'", literal)
+				return false
+			}
+		} else if value, _ := hexValue(digits[i]); base != 10 && int(value) >= base {
+			l.sink.Error(pos, "Invalid digit '%c' in %s literal '%s'", digits[i], baseNames[base], literal)
+			return false
+		}
+	}
+
+	return true
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.head < l.size {
 		switch l.ch {
@@ -156,14 +279,57 @@ func (l *Lexer) Next() token.Token {
 	}
 
 	if isDigit(l.ch) {
-		for l.head < l.size && isDigit(l.ch) {
+		base := 10
+		if l.ch == '0' {
+			switch l.peekChar(1) {
+			case 'x':
+				base = 16
+
+			case 'b':
+				base = 2
+
+			case 'o':
+				base = 8
+			}
+
+			if base != 10 {
+				l.nextChar()
+				l.nextChar()
+			}
+		}
+
+		digitsStart := l.head
+		l.readDigits(base)
+
+		// The fraction must start with a digit, otherwise '1..2' would be a float
+		isFloat := false
+		if base == 10 && l.ch == '.' && isDigit(l.peekChar(1)) {
+			isFloat = true
 			l.nextChar()
+			l.readDigits(base)
+		}
+
+		exponent := true
+		if base == 10 && (l.ch == 'e' || l.ch == 'E') {
+			isFloat = true
+			l.nextChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.nextChar()
+			}
+
+			exponent = l.head < l.size && isDigit(l.ch)
+			l.readDigits(base)
 		}
 
 		bits := 64
 		numStr := string(l.bytes[head:l.head])
+		valid := l.checkDigits(tok.Pos, numStr, string(l.bytes[digitsStart:l.head]), base)
+		if valid && !exponent {
+			l.sink.Error(tok.Pos, "Missing exponent digits in float literal '%s'", numStr)
+			valid = false
+		}
 
-		if l.ch == 'i' || l.ch == 'u' {
+		if l.ch == 'i' || l.ch == 'u' || l.ch == 'f' {
 			suffixPos := l.pos
 			suffixStart := l.head
 
@@ -184,27 +350,42 @@ func (l *Lexer) Next() token.Token {
 				"u16": {kind: token.U16, bits: 16},
 				"u32": {kind: token.U32, bits: 32},
 				"u64": {kind: token.U64, bits: 64},
+				"f32": {kind: token.F32, bits: 32},
+				"f64": {kind: token.F64, bits: 64},
 			}
 
+			// Float suffixes are only allowed on decimal literals
 			suffix := string(l.bytes[suffixStart:l.head])
-			if s, ok := suffixes[suffix]; ok {
+			s, ok := suffixes[suffix]
+			isFloatSuffix := s.kind == token.F32 || s.kind == token.F64
+			if ok && (isFloatSuffix && base == 10 || !isFloatSuffix && !isFloat) {
 				tok.Kind = s.kind
 				bits = s.bits
+			} else if isFloat {
+				l.sink.Error(suffixPos, "Invalid suffix '%s' to float literal", suffix)
+				tok.Kind = token.Float
 			} else {
-				fmt.Fprintf(
-					os.Stderr,
-					"%s: ERROR: Invalid suffix '%s' to integer literal\n",
-					suffixPos,
-					suffix,
-				)
-				os.Exit(1)
+				l.sink.Error(suffixPos, "Invalid suffix '%s' to integer literal", suffix)
+				tok.Kind = token.Int
 			}
+		} else if isFloat {
+			tok.Kind = token.Float
 		} else {
 			tok.Kind = token.Int
 		}
 
 		tok.Str = numStr
-		tok.ParseInteger(bits)
+		if !valid {
+			return tok
+		}
+
+		if tok.IsFloat() {
+			if err := tok.ParseFloat(bits); err != nil {
+				l.sink.Error(tok.Pos, "%s", err)
+			}
+		} else if err := tok.ParseInteger(bits); err != nil {
+			l.sink.Error(tok.Pos, "%s", err)
+		}
 		return tok
 	}
 
@@ -232,9 +413,24 @@ func (l *Lexer) Next() token.Token {
 		case "else":
 			tok.Kind = token.Else
 
+		case "match":
+			tok.Kind = token.Match
+
 		case "while":
 			tok.Kind = token.While
 
+		case "for":
+			tok.Kind = token.For
+
+		case "in":
+			tok.Kind = token.In
+
+		case "break":
+			tok.Kind = token.Break
+
+		case "continue":
+			tok.Kind = token.Continue
+
 		case "return":
 			tok.Kind = token.Return
 
@@ -244,6 +440,18 @@ func (l *Lexer) Next() token.Token {
 		case "let":
 			tok.Kind = token.Let
 
+		case "struct":
+			tok.Kind = token.Struct
+
+		case "enum":
+			tok.Kind = token.Enum
+
+		case "union":
+			tok.Kind = token.Union
+
+		case "extern":
+			tok.Kind = token.Extern
+
 		default:
 			tok.Kind = token.Ident
 		}
@@ -253,37 +461,43 @@ func (l *Lexer) Next() token.Token {
 
 	switch ch := l.readChar(); ch {
 	case '+':
-		tok.Kind = token.Add
+		tok.Kind = l.matchSet(token.Add, token.AddSet)
 
 	case '-':
-		tok.Kind = token.Sub
+		tok.Kind = l.matchSet(token.Sub, token.SubSet)
 
 	case '*':
-		tok.Kind = token.Mul
+		tok.Kind = l.matchSet(token.Mul, token.MulSet)
 
 	case '/':
-		tok.Kind = token.Div
+		tok.Kind = l.matchSet(token.Div, token.DivSet)
+
+	case '%':
+		tok.Kind = l.matchSet(token.Mod, token.ModSet)
 
 	case '|':
 		if l.matchChar('|') {
 			tok.Kind = token.LOr
 		} else {
-			tok.Kind = token.BOr
+			tok.Kind = l.matchSet(token.BOr, token.BOrSet)
 		}
 
 	case '&':
 		if l.matchChar('&') {
 			tok.Kind = token.LAnd
 		} else {
-			tok.Kind = token.BAnd
+			tok.Kind = l.matchSet(token.BAnd, token.BAndSet)
 		}
 
+	case '^':
+		tok.Kind = l.matchSet(token.BXor, token.BXorSet)
+
 	case '~':
 		tok.Kind = token.BNot
 
 	case '<':
 		if l.matchChar('<') {
-			tok.Kind = token.Shl
+			tok.Kind = l.matchSet(token.Shl, token.ShlSet)
 		} else if l.matchChar('=') {
 			tok.Kind = token.Le
 		} else {
@@ -292,7 +506,7 @@ func (l *Lexer) Next() token.Token {
 
 	case '>':
 		if l.matchChar('>') {
-			tok.Kind = token.Shr
+			tok.Kind = l.matchSet(token.Shr, token.ShrSet)
 		} else if l.matchChar('=') {
 			tok.Kind = token.Ge
 		} else {
@@ -302,6 +516,8 @@ func (l *Lexer) Next() token.Token {
 	case '=':
 		if l.matchChar('=') {
 			tok.Kind = token.Eq
+		} else if l.matchChar('>') {
+			tok.Kind = token.Arrow
 		} else {
 			tok.Kind = token.Set
 		}
@@ -315,9 +531,11 @@ func (l *Lexer) Next() token.Token {
 
 	case '{':
 		tok.Kind = token.LBrace
+		l.depth++
 
 	case '}':
 		tok.Kind = token.RBrace
+		l.depth--
 
 	case '(':
 		tok.Kind = token.LParen
@@ -325,9 +543,78 @@ func (l *Lexer) Next() token.Token {
 	case ')':
 		tok.Kind = token.RParen
 
+	case '[':
+		tok.Kind = token.LBracket
+
+	case ']':
+		tok.Kind = token.RBracket
+
+	case '"':
+		str := []byte{}
+		for !l.matchChar('"') {
+			if l.head >= l.size || l.ch == '\n' {
+				l.sink.Error(tok.Pos, "Unterminated string literal")
+				break
+			}
+
+			str = append(str, l.readLiteralChar())
+		}
+
+		tok.Kind = token.String
+		tok.Str = string(str)
+		return tok
+
+	case '\'':
+		// Character literals are just u8 integer literals
+		tok.Kind = token.U8
+		tok.Str = "0"
+
+		if l.matchChar('\'') {
+			l.sink.Error(tok.Pos, "Empty character literal")
+			return tok
+		}
+
+		if l.head >= l.size || l.ch == '\n' {
+			l.sink.Error(tok.Pos, "Unterminated character literal")
+			return tok
+		}
+
+		tok.Int = uint64(l.readLiteralChar())
+		tok.Str = strconv.FormatUint(tok.Int, 10)
+
+		if !l.matchChar('\'') {
+			// Skip the rest of the literal, if it is terminated at all
+			for l.head < l.size && l.ch != '\n' && l.ch != '\'' {
+				l.nextChar()
+			}
+
+			if l.matchChar('\'') {
+				l.sink.Error(tok.Pos, "Character literal must be a single byte")
+			} else {
+				l.sink.Error(tok.Pos, "Unterminated character literal")
+			}
+		}
+		return tok
+
 	case ',':
 		tok.Kind = token.Comma
 
+	case ':':
+		tok.Kind = token.Colon
+
+	case '.':
+		if l.matchChar('.') {
+			if l.matchChar('.') {
+				tok.Kind = token.Ellipsis
+			} else if l.matchChar('=') {
+				tok.Kind = token.DotDotEq
+			} else {
+				tok.Kind = token.DotDot
+			}
+		} else {
+			tok.Kind = token.Dot
+		}
+
 	case '#': // @Temporary
 		for l.head < l.size && isIdent(l.ch) {
 			l.nextChar()
@@ -341,31 +628,66 @@ func (l *Lexer) Next() token.Token {
 		case "#print":
 			tok.Kind = token.DebugPrint
 
+		case "#popcount":
+			tok.Kind = token.Popcount
+
+		case "#clz":
+			tok.Kind = token.Clz
+
+		case "#ctz":
+			tok.Kind = token.Ctz
+
+		case "#bswap":
+			tok.Kind = token.Bswap
+
+		case "#rotl":
+			tok.Kind = token.Rotl
+
+		case "#rotr":
+			tok.Kind = token.Rotr
+
+		case "#unchecked":
+			tok.Kind = token.Unchecked
+
 		default:
-			fmt.Fprintf(
-				os.Stderr,
-				"%s: ERROR: Invalid development intrinsic '%s'\n",
-				tok.Pos,
-				tok.Str,
-			)
-			os.Exit(1)
+			l.sink.Error(tok.Pos, "Invalid development intrinsic '%s'", tok.Str)
+
+			// Treat it as an identifier to keep going
+			tok.Kind = token.Ident
 		}
 		return tok
 
 	default:
-		message := "%s: ERROR: Invalid character '%c'\n"
+		message := "Invalid character '%c'"
 		if !isPrint(ch) {
-			message = "%s: ERROR: Invalid character %d\n"
+			message = "Invalid character %d"
 		}
+		l.sink.Error(tok.Pos, message, ch)
 
-		fmt.Fprintf(os.Stderr, message, tok.Pos, ch)
-		os.Exit(1)
+		// Skip it and carry on with the next token
+		l.onNewline = tok.OnNewline
+		return l.Next()
 	}
 
 	tok.Str = string(l.bytes[head:l.head])
 	return tok
 }
 
+// The number of braces which are open before the next token
+func (l *Lexer) Depth() int {
+	if l.peeked {
+		switch l.buffer.Kind {
+		case token.LBrace:
+			return l.depth - 1
+
+		case token.RBrace:
+			return l.depth + 1
+		}
+	}
+
+	return l.depth
+}
+
 func (l *Lexer) Peek() token.Token {
 	if !l.peeked {
 		l.Buffer(l.Next())
@@ -379,30 +701,6 @@ func (l *Lexer) Read(kind token.Kind) bool {
 	return !l.peeked
 }
 
-func (l *Lexer) Expect(kinds ...token.Kind) token.Token {
-	tok := l.Next()
-	if slices.Contains(kinds, tok.Kind) {
-		return tok
-	}
-
-	fmt.Fprintf(os.Stderr, "%s: ERROR: Expected ", tok.Pos)
-	for i, kind := range kinds {
-		if i > 0 {
-			if i == len(kinds)-1 {
-				fmt.Fprint(os.Stderr, " or ")
-			} else {
-				fmt.Fprint(os.Stderr, ", ")
-			}
-		}
-
-		fmt.Fprint(os.Stderr, token.Names[kind])
-	}
-	fmt.Fprintln(os.Stderr, ", got", token.Names[tok.Kind])
-	os.Exit(1)
-
-	panic("unreachable")
-}
-
 // In expressions, && is a single token. In a type, however it is 2 tokens.
 // Same goes for >> (for generic types)
 //
@@ -1,15 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"strings"
-	"yozi/checker"
-	"yozi/compiler"
-	"yozi/lexer"
-	"yozi/parser"
+	"yozi/driver"
 )
 
 func usage(w io.Writer) {
@@ -19,15 +18,24 @@ func usage(w io.Writer) {
 	fmt.Fprintln(w, "Flags:")
 	fmt.Fprintln(w, "    -h           Show this help message")
 	fmt.Fprintln(w, "    -r           Run the program after compiling it")
+	fmt.Fprintln(w, "    -debug       Abort on integer overflow and division by zero (default with -r)")
+	fmt.Fprintln(w, "    -release     Let integer arithmetic wrap around (default without -r)")
 	fmt.Fprintln(w, "    -o <name>    Set the name of the output executable")
+	fmt.Fprintln(w, "    -l <name>    Link with a library")
+	fmt.Fprintln(w, "    -L <flag>    Pass a flag to the linker (clang)")
 }
 
 type Args struct {
 	run  bool
 	rest []string
 
+	// Set by -debug and -release, otherwise the mode follows -r
+	debug   bool
+	release bool
+
 	inputPath  string
 	outputPath string
+	linkFlags  []string
 }
 
 func parseArgs() Args {
@@ -37,6 +45,7 @@ func parseArgs() Args {
 
 		inputPath:  "",
 		outputPath: "",
+		linkFlags:  []string{},
 	}
 
 	for len(args.rest) != 0 {
@@ -51,6 +60,14 @@ func parseArgs() Args {
 		case "-r":
 			args.run = true
 
+		case "-debug":
+			args.debug = true
+			args.release = false
+
+		case "-release":
+			args.release = true
+			args.debug = false
+
 		case "-o":
 			if len(args.rest) == 0 {
 				fmt.Fprintln(os.Stderr, "ERROR: Output file not provided")
@@ -62,6 +79,25 @@ func parseArgs() Args {
 			args.outputPath = args.rest[0]
 			args.rest = args.rest[1:]
 
+		case "-l", "-L":
+			if len(args.rest) == 0 {
+				if arg == "-l" {
+					fmt.Fprintln(os.Stderr, "ERROR: Library not provided")
+				} else {
+					fmt.Fprintln(os.Stderr, "ERROR: Linker flag not provided")
+				}
+				fmt.Fprintln(os.Stderr)
+				usage(os.Stderr)
+				os.Exit(1)
+			}
+
+			if arg == "-l" {
+				args.linkFlags = append(args.linkFlags, "-l"+args.rest[0])
+			} else {
+				args.linkFlags = append(args.linkFlags, args.rest[0])
+			}
+			args.rest = args.rest[1:]
+
 		default:
 			if strings.HasPrefix(arg, "-") {
 				fmt.Fprintln(os.Stderr, "ERROR: Invalid flag '"+arg+"'")
@@ -85,28 +121,34 @@ func parseArgs() Args {
 
 func main() {
 	args := parseArgs()
-
-	lexer, err := lexer.New(args.inputPath)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "ERROR: Could not open file '"+args.inputPath+"'")
-		fmt.Fprintln(os.Stderr)
-		usage(os.Stderr)
-		os.Exit(1)
+	if args.outputPath == "" {
+		args.outputPath = strings.TrimSuffix(args.inputPath, ".yo")
 	}
 
-	parser := parser.Parser{}
-	parser.File(lexer)
+	_, diagnostics, err := driver.Compile(driver.Options{
+		Path:       args.inputPath,
+		OutputPath: args.outputPath,
+		LinkFlags:  args.linkFlags,
+		Debug:      args.debug || args.run && !args.release,
+	})
 
-	context := checker.NewContext()
-	for _, node := range parser.Nodes {
-		context.Check(node)
+	for _, d := range diagnostics {
+		fmt.Fprint(os.Stderr, d)
 	}
 
-	if args.outputPath == "" {
-		args.outputPath = strings.TrimSuffix(args.inputPath, ".yo")
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) && pathErr.Path == args.inputPath {
+			fmt.Fprintln(os.Stderr, "ERROR: Could not open file '"+args.inputPath+"'")
+			fmt.Fprintln(os.Stderr)
+			usage(os.Stderr)
+		} else if !errors.Is(err, driver.ErrInvalid) {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+		}
+
+		os.Exit(1)
 	}
 
-	compiler.Program(&context, args.outputPath)
 	if args.run {
 		if !strings.HasPrefix(args.outputPath, "/") {
 			args.outputPath = "./" + args.outputPath
@@ -0,0 +1,150 @@
+package node
+
+import "yozi/token"
+
+// Returns a deep copy of a tree which has not been checked yet, so that it can
+// be checked again with different types
+//
+// @NodeKind
+func Clone(n Node) Node {
+	switch n := n.(type) {
+	case nil:
+		return nil
+
+	case *Atom:
+		return &Atom{Token: n.Token}
+
+	case *Call:
+		return &Call{Token: n.Token, Fn: Clone(n.Fn), Args: cloneAll(n.Args)}
+
+	case *Unary:
+		return &Unary{Token: n.Token, Operand: Clone(n.Operand)}
+
+	case *Binary:
+		return &Binary{Token: n.Token, Lhs: Clone(n.Lhs), Rhs: Clone(n.Rhs)}
+
+	case *Debug:
+		return &Debug{Token: n.Token, Operand: Clone(n.Operand)}
+
+	case *Intrinsic:
+		return &Intrinsic{Token: n.Token, Args: cloneAll(n.Args)}
+
+	case *If:
+		return &If{
+			Token:      n.Token,
+			Condition:  Clone(n.Condition),
+			Consequent: Clone(n.Consequent),
+			Antecedent: Clone(n.Antecedent),
+		}
+
+	case *Match:
+		match := &Match{
+			Token:   n.Token,
+			Subject: Clone(n.Subject),
+			Arms:    make([]*MatchArm, len(n.Arms)),
+			Else:    Clone(n.Else),
+		}
+
+		for i, arm := range n.Arms {
+			match.Arms[i] = &MatchArm{Patterns: cloneAll(arm.Patterns), Body: Clone(arm.Body)}
+		}
+
+		return match
+
+	case *While:
+		return &While{
+			Token:     n.Token,
+			Condition: Clone(n.Condition),
+			Body:      Clone(n.Body),
+			Label:     cloneLabel(n.Label),
+		}
+
+	case *For:
+		loop := &For{
+			Token:    n.Token,
+			Item:     Clone(n.Item).(*Let),
+			Iterable: Clone(n.Iterable),
+			Body:     Clone(n.Body),
+			Label:    cloneLabel(n.Label),
+		}
+
+		if n.Index != nil {
+			loop.Index = Clone(n.Index).(*Let)
+		}
+
+		return loop
+
+	case *Branch:
+		return &Branch{Token: n.Token, Label: cloneLabel(n.Label)}
+
+	case *Return:
+		return &Return{Token: n.Token, Operand: Clone(n.Operand)}
+
+	case *Fn:
+		fn := &Fn{
+			Token:     n.Token,
+			Args:      make([]*Let, len(n.Args)),
+			Return:    Clone(n.Return),
+			Locals:    []Node{},
+			Extern:    n.Extern,
+			Variadic:  n.Variadic,
+			Unchecked: n.Unchecked,
+			Generics:  n.Generics,
+		}
+
+		for i, arg := range n.Args {
+			fn.Args[i] = Clone(arg).(*Let)
+		}
+
+		if n.Body != nil {
+			fn.Body = Clone(n.Body).(*Block)
+		}
+
+		return fn
+
+	case *Let:
+		return &Let{Token: n.Token, Kind: n.Kind, Assign: Clone(n.Assign), DefType: Clone(n.DefType)}
+
+	case *Block:
+		return &Block{Token: n.Token, Nodes: cloneAll(n.Nodes)}
+
+	case *Compound:
+		compound := &Compound{Token: n.Token, Name: Clone(n.Name), Fields: make([]*Let, len(n.Fields))}
+		for i, field := range n.Fields {
+			compound.Fields[i] = Clone(field).(*Let)
+		}
+
+		return compound
+
+	case *Instance:
+		return &Instance{Token: n.Token, Fn: Clone(n.Fn), Args: cloneAll(n.Args)}
+
+	case *Array:
+		return &Array{Token: n.Token, Item: Clone(n.Item), Length: Clone(n.Length)}
+
+	default:
+		panic("unreachable")
+	}
+}
+
+func cloneAll(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+
+	result := make([]Node, len(nodes))
+	for i, n := range nodes {
+		result[i] = Clone(n)
+	}
+
+	return result
+}
+
+func cloneLabel(label *token.Token) *token.Token {
+	if label == nil {
+		return nil
+	}
+
+	clone := *label
+	return &clone
+}
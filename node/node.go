@@ -39,6 +39,9 @@ type Call struct {
 
 	Fn   Node
 	Args []Node
+
+	// The memory which union variants are constructed in, set by the checker
+	Temp *Let
 }
 
 func (c *Call) Literal() token.Token {
@@ -89,6 +92,10 @@ type Binary struct {
 	Rhs Node
 
 	Memory bool
+
+	// The memory which arrays not in memory are copied into to be indexed at
+	// runtime, set by the checker
+	Temp *Let
 }
 
 func (b *Binary) Literal() token.Token {
@@ -130,6 +137,30 @@ func (*Debug) IsMemory() bool {
 	return false
 }
 
+// Operations built into the compiler, like #popcount(x)
+type Intrinsic struct {
+	Token token.Token
+	Type  Type
+
+	Args []Node
+}
+
+func (i *Intrinsic) Literal() token.Token {
+	return i.Token
+}
+
+func (i *Intrinsic) GetType() Type {
+	return i.Type
+}
+
+func (i *Intrinsic) SetType(t Type) {
+	i.Type = t
+}
+
+func (*Intrinsic) IsMemory() bool {
+	return false
+}
+
 type If struct {
 	Token token.Token
 	Type  Type
@@ -155,12 +186,54 @@ func (*If) IsMemory() bool {
 	return false
 }
 
+// match subject { 1, 2 => ... 3..10 => ... else => ... }
+type Match struct {
+	Token token.Token
+	Type  Type
+
+	Subject Node
+	Arms    []*MatchArm
+	Else    Node // nil if there is no else arm
+
+	Exhaustive bool // Whether every value is matched, set by the checker
+	Temp       *Let // Holds the subject of matches on unions if it is not in memory
+}
+
+// The patterns are constants or ranges of constants (a binary '..' or '..=').
+// Patterns of unions are replaced with the tags of their variants
+type MatchArm struct {
+	Patterns []Node
+	Body     Node
+
+	// The payload fields bound by the pattern of a union variant, in order
+	Bindings []*Let
+}
+
+func (m *Match) Literal() token.Token {
+	return m.Token
+}
+
+func (m *Match) GetType() Type {
+	return m.Type
+}
+
+func (m *Match) SetType(t Type) {
+	m.Type = t
+}
+
+func (*Match) IsMemory() bool {
+	return false
+}
+
 type While struct {
 	Token token.Token
 	Type  Type
 
 	Condition Node
 	Body      Node
+
+	Label  *token.Token // nil for unlabeled loops
+	Breaks bool         // Whether a break exits this loop
 }
 
 func (w *While) Literal() token.Token {
@@ -179,6 +252,65 @@ func (*While) IsMemory() bool {
 	return false
 }
 
+// for item in iterable
+// for index, item in iterable
+//
+// The iterable is either a range (a binary '..' or '..=') or an array or slice
+type For struct {
+	Token token.Token
+	Type  Type
+
+	Index    *Let // Created by the checker if omitted, nil for ranges
+	Item     *Let
+	Iterable Node
+	Body     Node
+	Temp     *Let // Holds the array iterated over if it is not in memory
+
+	Label  *token.Token // nil for unlabeled loops
+	Breaks bool         // Whether a break exits this loop
+}
+
+func (f *For) Literal() token.Token {
+	return f.Token
+}
+
+func (f *For) GetType() Type {
+	return f.Type
+}
+
+func (f *For) SetType(t Type) {
+	f.Type = t
+}
+
+func (*For) IsMemory() bool {
+	return false
+}
+
+// A break or continue
+type Branch struct {
+	Token token.Token
+	Type  Type
+
+	Label *token.Token // nil for the innermost loop
+	Loop  Node
+}
+
+func (b *Branch) Literal() token.Token {
+	return b.Token
+}
+
+func (b *Branch) GetType() Type {
+	return b.Type
+}
+
+func (b *Branch) SetType(t Type) {
+	b.Type = t
+}
+
+func (*Branch) IsMemory() bool {
+	return false
+}
+
 type Return struct {
 	Token token.Token
 	Type  Type
@@ -203,14 +335,36 @@ func (*Return) IsMemory() bool {
 }
 
 type Fn struct {
-	Token token.Token
+	Token token.Token // The name, or the 'fn' of function literals
 	Type  Type
 
 	Args   []*Let
-	Body   *Block
+	Body   *Block // nil for extern functions
 	Return Node
 
-	Locals []Node
+	Locals    []Node
+	Extern    bool
+	Variadic  bool // C style variadic arguments
+	Unchecked bool // Debug checks are disabled
+
+	// The function which a nested function or function literal is defined in,
+	// nil for global functions
+	Parent *Fn
+
+	// The local variables and nested functions of the enclosing functions
+	// which are referenced, directly or by a nested function
+	Captures []Node
+
+	// fn max[T](a T, b T) T
+	//
+	// The body of a generic function is checked and compiled separately for
+	// every set of types it is instantiated with
+	Generics  []token.Token
+	Instances []*Fn
+
+	// The generic function which this is an instance of, nil otherwise
+	Generic  *Fn
+	TypeArgs []Type
 }
 
 func (f *Fn) Literal() token.Token {
@@ -244,6 +398,8 @@ const (
 	LetLocal
 	LetArg
 	LetLocalArg
+	LetField
+	LetVariant
 )
 
 type Let struct {
@@ -256,6 +412,10 @@ type Let struct {
 	// let x <type> = <expr> // Assign = <expr>, DefType = <type>
 	Assign  Node
 	DefType Node
+
+	// The value of Assign for global variables if it is known at compile time,
+	// otherwise the variable is assigned at runtime before main is called
+	Constant Node
 }
 
 func (l *Let) Literal() token.Token {
@@ -296,3 +456,207 @@ func (b *Block) SetType(t Type) {
 func (_ *Block) IsMemory() bool {
 	return false
 }
+
+type Struct struct {
+	Token token.Token
+	Type  Type
+
+	Fields []*Let
+}
+
+func (s *Struct) Literal() token.Token {
+	return s.Token
+}
+
+func (s *Struct) GetType() Type {
+	return s.Type
+}
+
+func (s *Struct) SetType(t Type) {
+	s.Type = t
+}
+
+func (_ *Struct) IsMemory() bool {
+	return false
+}
+
+func (s *Struct) Find(name string) int {
+	for i, field := range s.Fields {
+		if field.Token.Str == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+type Enum struct {
+	Token token.Token
+	Type  Type
+
+	DefType  Node // The underlying integer type, nil for i64
+	Variants []*Let
+}
+
+func (e *Enum) Literal() token.Token {
+	return e.Token
+}
+
+func (e *Enum) GetType() Type {
+	return e.Type
+}
+
+func (e *Enum) SetType(t Type) {
+	e.Type = t
+}
+
+func (_ *Enum) IsMemory() bool {
+	return false
+}
+
+func (e *Enum) BaseType() Type {
+	if e.DefType == nil {
+		return Type{Kind: TypeI64}
+	}
+
+	return e.DefType.GetType()
+}
+
+func (e *Enum) Find(name string) int {
+	for i, variant := range e.Variants {
+		if variant.Token.Str == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// union Shape { Circle(r i64), Rect(w i64, h i64), Empty }
+type Union struct {
+	Token token.Token
+	Type  Type
+
+	Variants []*Struct // The payloads, named after their variants
+}
+
+func (u *Union) Literal() token.Token {
+	return u.Token
+}
+
+func (u *Union) GetType() Type {
+	return u.Type
+}
+
+func (u *Union) SetType(t Type) {
+	u.Type = t
+}
+
+func (_ *Union) IsMemory() bool {
+	return false
+}
+
+func (u *Union) Find(name string) int {
+	for i, variant := range u.Variants {
+		if variant.Token.Str == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// The discriminant is the index of the variant
+func (u *Union) TagType() Type {
+	switch {
+	case len(u.Variants) <= 1<<8:
+		return Type{Kind: TypeU8}
+
+	case len(u.Variants) <= 1<<16:
+		return Type{Kind: TypeU16}
+
+	default:
+		return Type{Kind: TypeU32}
+	}
+}
+
+// Point{x: 1, y: 2}
+type Compound struct {
+	Token token.Token
+	Type  Type
+
+	Name   Node
+	Fields []*Let // Field = Token, Value = Assign
+}
+
+func (c *Compound) Literal() token.Token {
+	return c.Token
+}
+
+func (c *Compound) GetType() Type {
+	return c.Type
+}
+
+func (c *Compound) SetType(t Type) {
+	c.Type = t
+}
+
+func (*Compound) IsMemory() bool {
+	return false
+}
+
+// max[i64, u8]
+//
+// Explicit instantiation of a generic function. With a single type argument
+// which is also a valid expression, like max[i64], the parser cannot tell it
+// apart from indexing, and produces a binary '[' instead
+type Instance struct {
+	Token token.Token
+	Type  Type
+
+	Fn   Node
+	Args []Node
+}
+
+func (i *Instance) Literal() token.Token {
+	return i.Token
+}
+
+func (i *Instance) GetType() Type {
+	return i.Type
+}
+
+func (i *Instance) SetType(t Type) {
+	i.Type = t
+}
+
+func (*Instance) IsMemory() bool {
+	return false
+}
+
+// [Length]Item
+// []Item        // Length = nil
+type Array struct {
+	Token token.Token
+	Type  Type
+
+	Item   Node
+	Length Node
+	Count  uint64
+}
+
+func (a *Array) Literal() token.Token {
+	return a.Token
+}
+
+func (a *Array) GetType() Type {
+	return a.Type
+}
+
+func (a *Array) SetType(t Type) {
+	a.Type = t
+}
+
+func (*Array) IsMemory() bool {
+	return false
+}
@@ -1,6 +1,9 @@
 package node
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 type TypeKind = byte
 
@@ -17,8 +20,20 @@ const (
 	TypeU32
 	TypeU64
 
+	TypeF32
+	TypeF64
+
 	TypeFn
 	TypeRawptr
+	TypeStruct
+	TypeEnum
+	TypeUnion
+	TypeArray
+	TypeSlice
+
+	// Assigned to erroneous expressions so that checking can continue without
+	// reporting the same mistake over and over again
+	TypeError
 )
 
 type Type struct {
@@ -65,6 +80,12 @@ func (t Type) String() string {
 	case TypeU64:
 		sb.WriteString("u64")
 
+	case TypeF32:
+		sb.WriteString("f32")
+
+	case TypeF64:
+		sb.WriteString("f64")
+
 	case TypeFn:
 		fn := t.Spec.(*Fn)
 
@@ -76,6 +97,13 @@ func (t Type) String() string {
 
 			sb.WriteString(arg.Type.String())
 		}
+
+		if fn.Variadic {
+			if len(fn.Args) != 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("...")
+		}
 		sb.WriteByte(')')
 
 		if fn.Return != nil {
@@ -85,6 +113,23 @@ func (t Type) String() string {
 
 	case TypeRawptr:
 		sb.WriteString("rawptr")
+
+	case TypeStruct, TypeEnum, TypeUnion:
+		sb.WriteString(t.Spec.Literal().Str)
+
+	case TypeArray:
+		array := t.Spec.(*Array)
+		sb.WriteByte('[')
+		sb.WriteString(strconv.FormatUint(array.Count, 10))
+		sb.WriteByte(']')
+		sb.WriteString(array.Item.GetType().String())
+
+	case TypeSlice:
+		sb.WriteString("[]")
+		sb.WriteString(t.Spec.(*Array).Item.GetType().String())
+
+	case TypeError:
+		sb.WriteString("<error>")
 	}
 
 	return sb.String()
@@ -100,7 +145,7 @@ func (a Type) Equal(b Type) bool {
 		aSig := a.Spec.(*Fn)
 		bSig := b.Spec.(*Fn)
 
-		if len(aSig.Args) != len(bSig.Args) {
+		if len(aSig.Args) != len(bSig.Args) || aSig.Variadic != bSig.Variadic {
 			return false
 		}
 
@@ -113,11 +158,26 @@ func (a Type) Equal(b Type) bool {
 
 		return aSig.ReturnType().Equal(bSig.ReturnType())
 
+	case TypeStruct, TypeEnum, TypeUnion:
+		return a.Spec == b.Spec
+
+	case TypeArray:
+		aArray := a.Spec.(*Array)
+		bArray := b.Spec.(*Array)
+		return aArray.Count == bArray.Count && aArray.Item.GetType().Equal(bArray.Item.GetType())
+
+	case TypeSlice:
+		return a.Spec.(*Array).Item.GetType().Equal(b.Spec.(*Array).Item.GetType())
+
 	default:
 		return true
 	}
 }
 
+func (t Type) IsFloat() bool {
+	return t.Ref == 0 && (t.Kind == TypeF32 || t.Kind == TypeF64)
+}
+
 func (t Type) IsSignedInt() bool {
 	if t.Ref != 0 {
 		return false
@@ -127,7 +187,19 @@ func (t Type) IsSignedInt() bool {
 	case TypeU8, TypeU16, TypeU32, TypeU64:
 		return false
 
+	case TypeEnum:
+		return t.Underlying().IsSignedInt()
+
 	default:
 		return true
 	}
 }
+
+// Enums are represented by their underlying integer type
+func (t Type) Underlying() Type {
+	if t.Kind == TypeEnum && t.Ref == 0 {
+		return t.Spec.(*Enum).BaseType()
+	}
+
+	return t
+}
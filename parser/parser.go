@@ -1,8 +1,8 @@
 package parser
 
 import (
-	"fmt"
-	"os"
+	"strings"
+	"yozi/diagnostic"
 	"yozi/lexer"
 	"yozi/node"
 	"yozi/token"
@@ -29,16 +29,28 @@ var tokenPowers = [token.COUNT]int{
 
 	token.Mul: powerMul,
 	token.Div: powerMul,
+	token.Mod: powerMul,
 
 	token.Shl:  powerShl,
 	token.Shr:  powerShl,
 	token.BOr:  powerBor,
 	token.BAnd: powerBor,
+	token.BXor: powerBor,
 
 	token.LOr:  powerLor,
 	token.LAnd: powerLor,
 
-	token.Set: powerSet,
+	token.Set:     powerSet,
+	token.AddSet:  powerSet,
+	token.SubSet:  powerSet,
+	token.MulSet:  powerSet,
+	token.DivSet:  powerSet,
+	token.ModSet:  powerSet,
+	token.ShlSet:  powerSet,
+	token.ShrSet:  powerSet,
+	token.BOrSet:  powerSet,
+	token.BAndSet: powerSet,
+	token.BXorSet: powerSet,
 
 	token.Gt: powerCmp,
 	token.Ge: powerCmp,
@@ -47,24 +59,78 @@ var tokenPowers = [token.COUNT]int{
 	token.Eq: powerCmp,
 	token.Ne: powerCmp,
 
-	token.LParen: powerDot,
+	token.LParen:   powerDot,
+	token.LBracket: powerDot,
+	token.Dot:      powerDot,
 
 	token.As: powerAs,
 }
 
-func errorUnexpected(tok token.Token) {
-	fmt.Fprintf(os.Stderr, "%s: ERROR: Unexpected %s\n", tok.Pos, token.Names[tok.Kind])
-	os.Exit(1)
-}
+// Thrown on syntax errors to unwind to the enclosing statement
+type bailout struct{}
 
 type Parser struct {
 	lexer lexer.Lexer
 	local bool
 	Nodes []node.Node
+
+	// Compound literals are not allowed in places where a '{' would be
+	// ambiguous, like the condition of an if statement. Parenthesize them
+	noCompound bool
+
+	sink      *diagnostic.Sink
+	lastError token.Pos
+}
+
+func New(sink *diagnostic.Sink) Parser {
+	return Parser{sink: sink}
+}
+
+func (p *Parser) error(pos token.Pos, format string, args ...any) {
+	// Multiple errors at the same position are caused by the same mistake
+	if pos != p.lastError {
+		p.sink.Error(pos, format, args...)
+		p.lastError = pos
+	}
+
+	panic(bailout{})
+}
+
+// The offending token is put back, since it might be the start of the next
+// statement or the end of the current block
+func (p *Parser) errorUnexpected(tok token.Token) {
+	p.lexer.Buffer(tok)
+	p.error(tok.Pos, "Unexpected %s", token.Names[tok.Kind])
+}
+
+func (p *Parser) expect(kinds ...token.Kind) token.Token {
+	tok := p.lexer.Next()
+	for _, kind := range kinds {
+		if tok.Kind == kind {
+			return tok
+		}
+	}
+
+	sb := strings.Builder{}
+	for i, kind := range kinds {
+		if i > 0 {
+			if i == len(kinds)-1 {
+				sb.WriteString(" or ")
+			} else {
+				sb.WriteString(", ")
+			}
+		}
+
+		sb.WriteString(token.Names[kind])
+	}
+
+	p.lexer.Buffer(tok)
+	p.error(tok.Pos, "Expected %s, got %s", sb.String(), token.Names[tok.Kind])
+	panic("unreachable")
 }
 
 func tokenKindIsStartOfType(k token.Kind) bool {
-	return k == token.Ident || k == token.LAnd || k == token.BAnd || k == token.Fn
+	return k == token.Ident || k == token.LAnd || k == token.BAnd || k == token.Fn || k == token.LBracket
 }
 
 // @TokenKind
@@ -86,14 +152,30 @@ func (p *Parser) parseType() node.Node {
 			Operand: p.parseType(),
 		}
 
+	case token.LBracket:
+		array := node.Array{Token: tok}
+		if !p.lexer.Read(token.RBracket) {
+			array.Length = p.parseExpr(powerSet)
+			p.expect(token.RBracket)
+		}
+
+		array.Item = p.parseType()
+		return &array
+
 	case token.Fn:
-		p.lexer.Expect(token.LParen)
+		p.expect(token.LParen)
 		fn := node.Fn{
 			Token: tok,
 			Args:  []*node.Let{},
 		}
 
 		for !p.lexer.Read(token.RParen) {
+			if p.lexer.Read(token.Ellipsis) {
+				fn.Variadic = true
+				p.expect(token.RParen)
+				break
+			}
+
 			arg := node.Let{}
 
 			argToken := p.lexer.Next()
@@ -120,7 +202,7 @@ func (p *Parser) parseType() node.Node {
 			arg.Kind = node.LetArg
 			fn.Args = append(fn.Args, &arg)
 
-			if p.lexer.Expect(token.Comma, token.RParen).Kind == token.RParen {
+			if p.expect(token.Comma, token.RParen).Kind == token.RParen {
 				break
 			}
 		}
@@ -133,7 +215,7 @@ func (p *Parser) parseType() node.Node {
 		return &fn
 
 	default:
-		errorUnexpected(tok)
+		p.errorUnexpected(tok)
 	}
 
 	panic("unreachable")
@@ -145,9 +227,16 @@ func (p *Parser) parseExpr(mbp int) node.Node {
 
 	tok := p.lexer.Next()
 	switch tok.Kind {
-	case token.Bool, token.Ident:
+	case token.Bool, token.String:
 		n = &node.Atom{Token: tok}
 
+	case token.Ident:
+		n = &node.Atom{Token: tok}
+		if peek := p.lexer.Peek(); !p.noCompound && !peek.OnNewline && peek.Kind == token.LBrace {
+			p.lexer.Unbuffer()
+			n = p.parseCompound(n)
+		}
+
 	case token.Sub, token.Mul, token.BAnd, token.BNot, token.LNot:
 		n = &node.Unary{
 			Token:   tok,
@@ -155,22 +244,49 @@ func (p *Parser) parseExpr(mbp int) node.Node {
 		}
 
 	case token.LParen:
+		save := p.noCompound
+		p.noCompound = false
 		n = p.parseExpr(powerSet)
-		p.lexer.Expect(token.RParen)
+		p.noCompound = save
+		p.expect(token.RParen)
+
+	case token.Popcount, token.Clz, token.Ctz, token.Bswap, token.Rotl, token.Rotr:
+		intrinsic := node.Intrinsic{
+			Token: tok,
+			Args:  []node.Node{},
+		}
+
+		save := p.noCompound
+		p.noCompound = false
+		p.expect(token.LParen)
+		for !p.lexer.Read(token.RParen) {
+			intrinsic.Args = append(intrinsic.Args, p.parseExpr(powerSet))
+			if p.expect(token.Comma, token.RParen).Kind == token.RParen {
+				break
+			}
+		}
+		p.noCompound = save
+
+		n = &intrinsic
+
+	case token.Fn:
+		fn := node.Fn{Token: tok}
+		p.parseFn(&fn)
+		n = &fn
 
 	case token.DebugAlloc:
-		p.lexer.Expect(token.LParen)
+		p.expect(token.LParen)
 		n = &node.Debug{
 			Token:   tok,
 			Operand: p.parseExpr(powerSet),
 		}
-		p.lexer.Expect(token.RParen)
+		p.expect(token.RParen)
 
 	default:
-		if tok.IsInteger() {
+		if tok.IsInteger() || tok.IsFloat() {
 			n = &node.Atom{Token: tok}
 		} else {
-			errorUnexpected(tok)
+			p.errorUnexpected(tok)
 		}
 	}
 
@@ -194,12 +310,15 @@ func (p *Parser) parseExpr(mbp int) node.Node {
 				Args:  []node.Node{},
 			}
 
+			save := p.noCompound
+			p.noCompound = false
 			for !p.lexer.Read(token.RParen) {
 				call.Args = append(call.Args, p.parseExpr(powerSet))
-				if p.lexer.Expect(token.Comma, token.RParen).Kind == token.RParen {
+				if p.expect(token.Comma, token.RParen).Kind == token.RParen {
 					break
 				}
 			}
+			p.noCompound = save
 
 			n = &call
 
@@ -210,6 +329,20 @@ func (p *Parser) parseExpr(mbp int) node.Node {
 				Rhs:   p.parseType(),
 			}
 
+		case token.LBracket:
+			save := p.noCompound
+			p.noCompound = false
+			n = p.parseIndexOrInstance(tok, n)
+			p.noCompound = save
+			p.expect(token.RBracket)
+
+		case token.Dot:
+			n = &node.Binary{
+				Token: tok,
+				Lhs:   n,
+				Rhs:   &node.Atom{Token: p.expect(token.Ident)},
+			}
+
 		default:
 			n = &node.Binary{
 				Token: tok,
@@ -222,6 +355,158 @@ func (p *Parser) parseExpr(mbp int) node.Node {
 	return n
 }
 
+// xs[index]
+// max[i64, []u8]
+func (p *Parser) parseIndexOrInstance(tok token.Token, lhs node.Node) node.Node {
+	instance := node.Instance{
+		Token: tok,
+		Fn:    lhs,
+		Args:  []node.Node{},
+	}
+
+	// Types which are not valid expressions
+	switch peek := p.lexer.Peek(); peek.Kind {
+	case token.LAnd, token.LBracket, token.Fn:
+		instance.Args = append(instance.Args, p.parseType())
+
+	default:
+		index := p.parseIndex()
+		if peek := p.lexer.Peek(); peek.Kind != token.Comma {
+			return &node.Binary{
+				Token: tok,
+				Lhs:   lhs,
+				Rhs:   index,
+			}
+		}
+
+		instance.Args = append(instance.Args, index)
+	}
+
+	for p.lexer.Read(token.Comma) {
+		instance.Args = append(instance.Args, p.parseType())
+	}
+
+	return &instance
+}
+
+// xs[index]
+// xs[start..end] // Both bounds are optional
+func (p *Parser) parseIndex() node.Node {
+	var start node.Node
+	if tok := p.lexer.Peek(); tok.Kind != token.DotDot {
+		start = p.parseExpr(powerSet)
+	}
+
+	tok := p.lexer.Peek()
+	if tok.Kind != token.DotDot {
+		return start
+	}
+	p.lexer.Unbuffer()
+
+	slice := node.Binary{
+		Token: tok,
+		Lhs:   start,
+	}
+
+	if peek := p.lexer.Peek(); peek.Kind != token.RBracket {
+		slice.Rhs = p.parseExpr(powerSet)
+	}
+
+	return &slice
+}
+
+func (p *Parser) parseCompound(name node.Node) node.Node {
+	compound := node.Compound{
+		Token:  name.Literal(),
+		Name:   name,
+		Fields: []*node.Let{},
+	}
+
+	save := p.noCompound
+	p.noCompound = false
+	for !p.lexer.Read(token.RBrace) {
+		field := node.Let{Token: p.expect(token.Ident)}
+		p.expect(token.Colon)
+		field.Assign = p.parseExpr(powerSet)
+		compound.Fields = append(compound.Fields, &field)
+
+		if p.expect(token.Comma, token.RBrace).Kind == token.RBrace {
+			break
+		}
+	}
+	p.noCompound = save
+
+	return &compound
+}
+
+// (name type, name type, ...) // Variadic arguments are only allowed in extern functions
+func (p *Parser) parseArgs(fn *node.Fn, variadic bool) {
+	p.expect(token.LParen)
+	for !p.lexer.Read(token.RParen) {
+		if variadic && p.lexer.Read(token.Ellipsis) {
+			fn.Variadic = true
+			p.expect(token.RParen)
+			break
+		}
+
+		arg := node.Let{}
+		arg.Token = p.expect(token.Ident)
+		arg.Kind = node.LetArg
+		arg.DefType = p.parseType()
+		fn.Args = append(fn.Args, &arg)
+
+		if p.expect(token.Comma, token.RParen).Kind == token.RParen {
+			break
+		}
+	}
+}
+
+// The arguments, return type and body of a function, named or literal
+func (p *Parser) parseFn(fn *node.Fn) {
+	fn.Args = []*node.Let{}
+	fn.Locals = []node.Node{}
+
+	save := p.local
+	saveCompound := p.noCompound
+	p.local = true
+	p.noCompound = false
+	{
+		p.parseArgs(fn, false)
+		if peek := p.lexer.Peek(); peek.Kind != token.LBrace {
+			fn.Return = p.parseType()
+		}
+
+		p.lexer.Buffer(p.expect(token.LBrace))
+		fn.Body = p.parseStmt().(*node.Block)
+	}
+	p.local = save
+	p.noCompound = saveCompound
+}
+
+func (p *Parser) parseCondition() node.Node {
+	save := p.noCompound
+	p.noCompound = true
+	condition := p.parseExpr(powerSet)
+	p.noCompound = save
+	return condition
+}
+
+// start..end
+// start..=end
+func (p *Parser) parseRangeOrCondition() node.Node {
+	n := p.parseCondition()
+	if peek := p.lexer.Peek(); peek.Kind == token.DotDot || peek.Kind == token.DotDotEq {
+		p.lexer.Unbuffer()
+		n = &node.Binary{
+			Token: peek,
+			Lhs:   n,
+			Rhs:   p.parseCondition(),
+		}
+	}
+
+	return n
+}
+
 func (p *Parser) localAssert(tok token.Token, local bool) {
 	if p.local != local {
 		scope := "global"
@@ -229,14 +514,7 @@ func (p *Parser) localAssert(tok token.Token, local bool) {
 			scope = "local"
 		}
 
-		fmt.Fprintf(
-			os.Stderr,
-			"%s: ERROR: Unexpected %s in %s scope\n",
-			tok.Pos,
-			token.Names[tok.Kind],
-			scope,
-		)
-		os.Exit(1)
+		p.error(tok.Pos, "Unexpected %s in %s scope", token.Names[tok.Kind], scope)
 	}
 }
 
@@ -252,15 +530,15 @@ func (p *Parser) parseStmt() node.Node {
 
 	case token.If:
 		p.localAssert(tok, true)
-		condition := p.parseExpr(powerSet)
+		condition := p.parseCondition()
 
-		p.lexer.Buffer(p.lexer.Expect(token.LBrace))
+		p.lexer.Buffer(p.expect(token.LBrace))
 		consequent := p.parseStmt()
 
 		antecedent := node.Node(&node.Block{})
 
 		if p.lexer.Read(token.Else) {
-			p.lexer.Buffer(p.lexer.Expect(token.LBrace, token.If))
+			p.lexer.Buffer(p.expect(token.LBrace, token.If))
 			antecedent = p.parseStmt()
 		}
 
@@ -271,11 +549,49 @@ func (p *Parser) parseStmt() node.Node {
 			Consequent: consequent,
 		}
 
+	case token.Match:
+		p.localAssert(tok, true)
+		match := node.Match{
+			Token:   tok,
+			Subject: p.parseCondition(),
+			Arms:    []*node.MatchArm{},
+		}
+
+		p.expect(token.LBrace)
+		for !p.lexer.Read(token.RBrace) {
+			if tok := p.lexer.Peek(); tok.Kind == token.Else {
+				p.lexer.Unbuffer()
+
+				// Not a syntax error, the rest of the match can still be parsed
+				if match.Else != nil {
+					p.sink.Error(tok.Pos, "Duplicate else in match")
+				}
+
+				p.expect(token.Arrow)
+				match.Else = p.parseStmt()
+				continue
+			}
+
+			arm := node.MatchArm{}
+			for {
+				arm.Patterns = append(arm.Patterns, p.parseRangeOrCondition())
+				if !p.lexer.Read(token.Comma) {
+					break
+				}
+			}
+
+			p.expect(token.Arrow)
+			arm.Body = p.parseStmt()
+			match.Arms = append(match.Arms, &arm)
+		}
+
+		return &match
+
 	case token.While:
 		p.localAssert(tok, true)
-		condition := p.parseExpr(powerSet)
+		condition := p.parseCondition()
 
-		p.lexer.Buffer(p.lexer.Expect(token.LBrace))
+		p.lexer.Buffer(p.expect(token.LBrace))
 		body := p.parseStmt()
 
 		return &node.While{
@@ -284,6 +600,33 @@ func (p *Parser) parseStmt() node.Node {
 			Body:      body,
 		}
 
+	case token.For:
+		p.localAssert(tok, true)
+
+		loop := node.For{Token: tok}
+		loop.Item = &node.Let{Token: p.expect(token.Ident), Kind: node.LetLocal}
+		if p.lexer.Read(token.Comma) {
+			loop.Index = loop.Item
+			loop.Item = &node.Let{Token: p.expect(token.Ident), Kind: node.LetLocal}
+		}
+		p.expect(token.In)
+
+		loop.Iterable = p.parseRangeOrCondition()
+		p.lexer.Buffer(p.expect(token.LBrace))
+		loop.Body = p.parseStmt()
+		return &loop
+
+	case token.Break, token.Continue:
+		p.localAssert(tok, true)
+
+		branch := node.Branch{Token: tok}
+		if peek := p.lexer.Peek(); !peek.OnNewline && peek.Kind == token.Ident {
+			p.lexer.Unbuffer()
+			branch.Label = &peek
+		}
+
+		return &branch
+
 	case token.Return:
 		p.localAssert(tok, true)
 
@@ -295,42 +638,151 @@ func (p *Parser) parseStmt() node.Node {
 		return &ret
 
 	case token.Fn:
-		p.localAssert(tok, false) // TODO: Nested functions
-		fn := node.Fn{
-			Token:  p.lexer.Expect(token.Ident),
-			Args:   []*node.Let{},
-			Locals: []node.Node{},
+		fn := node.Fn{Token: p.expect(token.Ident)}
+
+		// Type parameters
+		if p.lexer.Read(token.LBracket) {
+			fn.Generics = []token.Token{}
+			for {
+				fn.Generics = append(fn.Generics, p.expect(token.Ident))
+				if p.expect(token.Comma, token.RBracket).Kind == token.RBracket {
+					break
+				}
+			}
 		}
 
-		p.local = true
-		{
-			p.lexer.Expect(token.LParen)
-			for !p.lexer.Read(token.RParen) {
-				arg := node.Let{}
-				arg.Token = p.lexer.Expect(token.Ident)
-				arg.Kind = node.LetArg
-				arg.DefType = p.parseType()
-				fn.Args = append(fn.Args, &arg)
+		p.parseFn(&fn)
+		return &fn
 
-				if p.lexer.Expect(token.Comma, token.RParen).Kind == token.RParen {
-					break
+	case token.Struct:
+		p.localAssert(tok, false)
+		s := node.Struct{
+			Token:  p.expect(token.Ident),
+			Fields: []*node.Let{},
+		}
+
+		p.expect(token.LBrace)
+		for !p.lexer.Read(token.RBrace) {
+			field := node.Let{
+				Token: p.expect(token.Ident),
+				Kind:  node.LetField,
+			}
+			field.DefType = p.parseType()
+			s.Fields = append(s.Fields, &field)
+
+			// Fields are separated by either commas or newlines
+			if !p.lexer.Read(token.Comma) {
+				if peek := p.lexer.Peek(); !peek.OnNewline && peek.Kind != token.RBrace {
+					p.errorUnexpected(peek)
 				}
 			}
+		}
+
+		return &s
+
+	case token.Enum:
+		p.localAssert(tok, false)
+		e := node.Enum{
+			Token:    p.expect(token.Ident),
+			Variants: []*node.Let{},
+		}
 
-			if peek := p.lexer.Peek(); peek.Kind != token.LBrace {
-				fn.Return = p.parseType()
+		if peek := p.lexer.Peek(); peek.Kind != token.LBrace {
+			e.DefType = p.parseType()
+		}
+
+		p.expect(token.LBrace)
+		for !p.lexer.Read(token.RBrace) {
+			variant := node.Let{
+				Token: p.expect(token.Ident),
+				Kind:  node.LetVariant,
 			}
 
-			p.lexer.Buffer(p.lexer.Expect(token.LBrace))
-			fn.Body = p.parseStmt().(*node.Block)
+			if p.lexer.Read(token.Set) {
+				variant.Assign = p.parseExpr(powerSet)
+			}
+			e.Variants = append(e.Variants, &variant)
+
+			// Variants are separated by either commas or newlines
+			if !p.lexer.Read(token.Comma) {
+				if peek := p.lexer.Peek(); !peek.OnNewline && peek.Kind != token.RBrace {
+					p.errorUnexpected(peek)
+				}
+			}
+		}
+
+		return &e
+
+	case token.Union:
+		p.localAssert(tok, false)
+		u := node.Union{
+			Token:    p.expect(token.Ident),
+			Variants: []*node.Struct{},
+		}
+
+		p.expect(token.LBrace)
+		for !p.lexer.Read(token.RBrace) {
+			variant := node.Struct{
+				Token:  p.expect(token.Ident),
+				Fields: []*node.Let{},
+			}
+
+			// Variants without a payload have no parentheses
+			if p.lexer.Read(token.LParen) {
+				for !p.lexer.Read(token.RParen) {
+					field := node.Let{
+						Token: p.expect(token.Ident),
+						Kind:  node.LetField,
+					}
+					field.DefType = p.parseType()
+					variant.Fields = append(variant.Fields, &field)
+
+					if p.expect(token.Comma, token.RParen).Kind == token.RParen {
+						break
+					}
+				}
+			}
+			u.Variants = append(u.Variants, &variant)
+
+			// Variants are separated by either commas or newlines
+			if !p.lexer.Read(token.Comma) {
+				if peek := p.lexer.Peek(); !peek.OnNewline && peek.Kind != token.RBrace {
+					p.errorUnexpected(peek)
+				}
+			}
+		}
+
+		return &u
+
+	case token.Unchecked:
+		p.localAssert(tok, false)
+		p.lexer.Buffer(p.expect(token.Fn))
+
+		fn := p.parseStmt().(*node.Fn)
+		fn.Unchecked = true
+		return fn
+
+	case token.Extern:
+		p.localAssert(tok, false)
+		p.expect(token.Fn)
+
+		fn := node.Fn{
+			Token:  p.expect(token.Ident),
+			Args:   []*node.Let{},
+			Locals: []node.Node{},
+			Extern: true,
+		}
+
+		p.parseArgs(&fn, true)
+		if peek := p.lexer.Peek(); !peek.OnNewline && tokenKindIsStartOfType(peek.Kind) {
+			fn.Return = p.parseType()
 		}
-		p.local = false
 
 		return &fn
 
 	case token.Let:
 		let := node.Let{
-			Token: p.lexer.Expect(token.Ident),
+			Token: p.expect(token.Ident),
 		}
 
 		if tok := p.lexer.Peek(); tok.Kind != token.Set {
@@ -359,7 +811,13 @@ func (p *Parser) parseStmt() node.Node {
 				break
 			}
 
-			body = append(body, p.parseStmt())
+			if tok.Kind == token.Eof {
+				p.errorUnexpected(tok)
+			}
+
+			if stmt := p.parseStmtOrSkip(); stmt != nil {
+				body = append(body, stmt)
+			}
 		}
 
 		return &node.Block{
@@ -370,10 +828,80 @@ func (p *Parser) parseStmt() node.Node {
 	default:
 		p.localAssert(tok, true)
 		p.lexer.Buffer(tok)
-		return p.parseExpr(powerNil)
+		expr := p.parseExpr(powerNil)
+
+		// Labeled loop
+		if label, ok := expr.(*node.Atom); ok && label.Token.Kind == token.Ident {
+			if p.lexer.Read(token.Colon) {
+				p.lexer.Buffer(p.expect(token.While, token.For))
+
+				loop := p.parseStmt()
+				switch loop := loop.(type) {
+				case *node.While:
+					loop.Label = &label.Token
+
+				case *node.For:
+					loop.Label = &label.Token
+				}
+
+				return loop
+			}
+		}
+
+		return expr
 	}
 }
 
+func tokenKindIsStartOfGlobal(k token.Kind) bool {
+	return k == token.Fn || k == token.Let || k == token.Struct || k == token.Enum || k == token.Union || k == token.Extern || k == token.Unchecked
+}
+
+// Skip to the start of the next statement after a syntax error, so that a
+// single mistake does not cascade into a bunch of unrelated errors. The braces
+// opened by the statement are skipped as well, even if the error is within them
+func (p *Parser) sync(start token.Token, depth int) {
+	for {
+		tok := p.lexer.Peek()
+		if tok.Kind == token.Eof {
+			return
+		}
+
+		if p.lexer.Depth() <= depth && tok.Pos != start.Pos {
+			if p.local && tok.Kind == token.RBrace {
+				return
+			}
+
+			if tok.OnNewline && (p.local || tokenKindIsStartOfGlobal(tok.Kind)) {
+				return
+			}
+		}
+		p.lexer.Unbuffer()
+	}
+}
+
+// Returns nil if the statement could not be parsed
+func (p *Parser) parseStmtOrSkip() (n node.Node) {
+	start := p.lexer.Peek()
+	depth := p.lexer.Depth()
+	local := p.local
+	noCompound := p.noCompound
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+
+			p.local = local
+			p.noCompound = noCompound
+			p.sync(start, depth)
+			n = nil
+		}
+	}()
+
+	return p.parseStmt()
+}
+
 func (p *Parser) File(lexer lexer.Lexer) {
 	save := p.lexer
 	if p.Nodes == nil {
@@ -382,7 +910,9 @@ func (p *Parser) File(lexer lexer.Lexer) {
 
 	p.lexer = lexer
 	for !p.lexer.Read(token.Eof) {
-		p.Nodes = append(p.Nodes, p.parseStmt())
+		if stmt := p.parseStmtOrSkip(); stmt != nil {
+			p.Nodes = append(p.Nodes, stmt)
+		}
 	}
 	p.lexer = save
 }
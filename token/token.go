@@ -2,8 +2,9 @@ package token
 
 import (
 	"fmt"
-	"os"
+	"math"
 	"strconv"
+	"strings"
 )
 
 type Pos struct {
@@ -31,18 +32,25 @@ const (
 	U64
 	Int // Untyped
 
+	F32
+	F64
+	Float // Untyped
+
 	Bool
+	String
 	Ident
 
 	Add
 	Sub
 	Mul
 	Div
+	Mod
 
 	Shl
 	Shr
 	BOr
 	BAnd
+	BXor
 	BNot
 
 	LOr
@@ -50,6 +58,16 @@ const (
 	LNot
 
 	Set
+	AddSet
+	SubSet
+	MulSet
+	DivSet
+	ModSet
+	ShlSet
+	ShrSet
+	BOrSet
+	BAndSet
+	BXorSet
 
 	Gt
 	Ge
@@ -62,22 +80,48 @@ const (
 	RBrace
 	LParen
 	RParen
+	LBracket
+	RBracket
 
 	Comma
+	Colon
+	Dot
+	DotDot
+	DotDotEq
+	Ellipsis
+	Arrow
 
 	As
 
 	If
 	Else
+	Match
 	While
+	For
+	In
+	Break
+	Continue
 	Return
 
 	Fn
 	Let
+	Struct
+	Enum
+	Union
+	Extern
+
+	Unchecked
 
 	DebugAlloc
 	DebugPrint
 
+	Popcount
+	Clz
+	Ctz
+	Bswap
+	Rotl
+	Rotr
+
 	COUNT
 )
 
@@ -95,25 +139,42 @@ var Names = [COUNT]string{
 	U64: "integer",
 	Int: "integer",
 
-	Bool:  "boolean",
-	Ident: "identifier",
+	F32:   "float",
+	F64:   "float",
+	Float: "float",
+
+	Bool:   "boolean",
+	String: "string",
+	Ident:  "identifier",
 
 	Add: "'+'",
 	Sub: "'-'",
 	Mul: "'*'",
 	Div: "'/'",
+	Mod: "'%'",
 
 	Shl:  "'<<'",
 	Shr:  "'>>'",
 	BOr:  "'|'",
 	BAnd: "'&'",
+	BXor: "'^'",
 	BNot: "'~'",
 
 	LOr:  "'||'",
 	LAnd: "'&&'",
 	LNot: "'!'",
 
-	Set: "'='",
+	Set:     "'='",
+	AddSet:  "'+='",
+	SubSet:  "'-='",
+	MulSet:  "'*='",
+	DivSet:  "'/='",
+	ModSet:  "'%='",
+	ShlSet:  "'<<='",
+	ShrSet:  "'>>='",
+	BOrSet:  "'|='",
+	BAndSet: "'&='",
+	BXorSet: "'^='",
 
 	Gt: "'>'",
 	Ge: "'>='",
@@ -122,25 +183,51 @@ var Names = [COUNT]string{
 	Eq: "'=='",
 	Ne: "'!='",
 
-	LBrace: "'{'",
-	RBrace: "'}'",
-	LParen: "'('",
-	RParen: "')'",
-
-	Comma: "','",
+	LBrace:   "'{'",
+	RBrace:   "'}'",
+	LParen:   "'('",
+	RParen:   "')'",
+	LBracket: "'['",
+	RBracket: "']'",
+
+	Comma:    "','",
+	Colon:    "':'",
+	Dot:      "'.'",
+	DotDot:   "'..'",
+	DotDotEq: "'..='",
+	Ellipsis: "'...'",
+	Arrow:    "'=>'",
 
 	As: "'as'",
 
-	If:     "'if'",
-	Else:   "'else'",
-	While:  "'while'",
-	Return: "'return'",
-
-	Fn:  "'fn'",
-	Let: "'let'",
+	If:       "'if'",
+	Else:     "'else'",
+	Match:    "'match'",
+	While:    "'while'",
+	For:      "'for'",
+	In:       "'in'",
+	Break:    "'break'",
+	Continue: "'continue'",
+	Return:   "'return'",
+
+	Fn:     "'fn'",
+	Let:    "'let'",
+	Struct: "'struct'",
+	Enum:   "'enum'",
+	Union:  "'union'",
+	Extern: "'extern'",
+
+	Unchecked: "'#unchecked'",
 
 	DebugAlloc: "'#alloc'",
 	DebugPrint: "'#print'",
+
+	Popcount: "'#popcount'",
+	Clz:      "'#clz'",
+	Ctz:      "'#ctz'",
+	Bswap:    "'#bswap'",
+	Rotl:     "'#rotl'",
+	Rotr:     "'#rotr'",
 }
 
 type Token struct {
@@ -149,7 +236,8 @@ type Token struct {
 	Str       string
 	OnNewline bool
 
-	Int uint64
+	Int   uint64
+	Float float64
 }
 
 // @TokenKind
@@ -163,36 +251,83 @@ func (t Token) IsInteger() bool {
 	}
 }
 
-func (t *Token) ParseInteger(bits int) {
-	var err error
+// @TokenKind
+func (t Token) IsFloat() bool {
+	return t.Kind == F32 || t.Kind == F64 || t.Kind == Float
+}
+
+// Returns an error if the literal does not fit within the given bits. Signed
+// literals may also be the magnitude of the minimum value, which only fits when
+// negated like -128i8, so that is left to the checker. Untyped literals can be
+// up to 64 bits, their range is checked once they are given a type
+func (t *Token) ParseInteger(bits int) error {
 	var typeName string
+	var limit uint64
 
 	switch t.Kind {
-	case I8, I16, I32, I64, Int:
+	case I8, I16, I32, I64:
 		typeName = fmt.Sprintf("i%d", bits)
+		limit = 1 << (bits - 1)
 
-		var temp int64
-		temp, err = strconv.ParseInt(t.Str, 10, bits)
-
-		// Integer literals are always positive hence int64 fits within uint64
-		t.Int = uint64(temp)
-
-	case U8, U16, U32, U64:
+	case U8, U16, U32, U64, Int:
 		typeName = fmt.Sprintf("u%d", bits)
-		t.Int, err = strconv.ParseUint(t.Str, 10, bits)
+		limit = math.MaxUint64 >> (64 - bits)
 
 	default:
 		panic("unreachable")
 	}
 
+	digits, base := literalDigits(t.Str)
+	value, err := strconv.ParseUint(digits, base, 64)
+	if err != nil || value > limit {
+		return fmt.Errorf("Integer literal '%s' is too large for type %s", t.Str, typeName)
+	}
+
+	t.Int = value
+	return nil
+}
+
+// Returns an error if the literal is too large for a float of the given bits
+func (t *Token) ParseFloat(bits int) error {
+	digits, base := literalDigits(t.Str)
+	if base != 10 {
+		// Only integer literals have a base prefix, and those always fit
+		value, _ := strconv.ParseUint(digits, base, 64)
+		t.Float = float64(value)
+		if bits == 32 {
+			t.Float = float64(float32(t.Float))
+		}
+		return nil
+	}
+
+	var err error
+	t.Float, err = strconv.ParseFloat(digits, bits)
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"%s: ERROR: Integer literal '%s' is too large for type %s\n",
-			t.Pos,
-			t.Str,
-			typeName,
-		)
-		os.Exit(1)
+		return fmt.Errorf("Float literal '%s' is too large for type f%d", t.Str, bits)
+	}
+
+	return nil
+}
+
+// Strips the base prefix and the digit separators from a numeric literal
+func literalDigits(str string) (string, int) {
+	base := 10
+	if len(str) >= 2 && str[0] == '0' {
+		switch str[1] {
+		case 'x':
+			base = 16
+
+		case 'b':
+			base = 2
+
+		case 'o':
+			base = 8
+		}
+
+		if base != 10 {
+			str = str[2:]
+		}
 	}
+
+	return strings.ReplaceAll(str, "_", ""), base
 }